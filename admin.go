@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The admin socket accepts a single command line per connection. The daemon
+// answers with a status line ("OK" or "ERR <message>") followed by the output
+// of the command.
+
+type adminServer struct {
+	server     *SSHServer
+	configFile string
+}
+
+type adminHandler func(a *adminServer, args []string, w io.Writer) error
+
+var adminCommands = map[string]adminHandler{
+	"reload":         adminReload,
+	"bans":           adminBans,
+	"unban":          adminUnban,
+	"hostkeys":       adminHostKeys,
+	"accept-hostkey": adminAcceptHostKey,
+}
+
+func adminReload(a *adminServer, args []string, w io.Writer) error {
+	if err := a.server.ReloadConfig(a.configFile); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Configuration reloaded from %s\n", a.configFile)
+	return nil
+}
+
+func adminBans(a *adminServer, args []string, w io.Writer) error {
+	status := limiter.Status()
+	if len(status) == 0 {
+		fmt.Fprintf(w, "No authentication failures tracked\n")
+	}
+	for _, line := range status {
+		fmt.Fprintf(w, "%s\n", line)
+	}
+	return nil
+}
+
+func adminUnban(a *adminServer, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("Usage: unban <ip|user|all>")
+	}
+	removed := limiter.Unban(args[0])
+	if len(removed) == 0 {
+		return fmt.Errorf("No ban or failure tracked for %s", args[0])
+	}
+	for _, key := range removed {
+		fmt.Fprintf(w, "Cleared %s\n", key)
+	}
+	return nil
+}
+
+func adminHostKeys(a *adminServer, args []string, w io.Writer) error {
+	known, pending, err := knownHosts.List(currentConfig())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Pinned host keys:\n")
+	for _, h := range known {
+		fmt.Fprintf(w, "  %s\n", h)
+	}
+	fmt.Fprintf(w, "Pending host keys:\n")
+	for _, h := range pending {
+		fmt.Fprintf(w, "  %s\n", h)
+	}
+	return nil
+}
+
+func adminAcceptHostKey(a *adminServer, args []string, w io.Writer) error {
+	if len(args) != 1 {
+		return errors.New("Usage: accept-hostkey <server|address>")
+	}
+	accepted, err := knownHosts.Accept(currentConfig(), args[0])
+	if err != nil {
+		return err
+	}
+	for _, h := range accepted {
+		fmt.Fprintf(w, "Pinned %s\n", h)
+	}
+	return nil
+}
+
+func (s *SSHServer) ListenAdmin(path string, configFile string) error {
+	if _, err := os.Stat(path); err == nil {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to listen on admin socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return fmt.Errorf("Unable to set admin socket permissions: %v", err)
+	}
+
+	a := &adminServer{server: s, configFile: configFile}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("Admin socket closed: %v", err)
+				return
+			}
+			go a.handle(conn)
+		}
+	}()
+	return nil
+}
+
+func (a *adminServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	args := strings.Fields(line)
+	if len(args) == 0 {
+		fmt.Fprintf(conn, "ERR Missing command\n")
+		return
+	}
+
+	if args[0] == "help" {
+		names := []string{}
+		for name := range adminCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(conn, "OK\nAvailable commands: %s\n", strings.Join(names, ", "))
+		return
+	}
+
+	handler, ok := adminCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(conn, "ERR Unknown command %s\n", args[0])
+		return
+	}
+
+	log.Printf("Admin command received: %s", strings.Join(args, " "))
+	out := new(bytes.Buffer)
+	if err := handler(a, args[1:], out); err != nil {
+		fmt.Fprintf(conn, "ERR %v\n", err)
+	} else {
+		fmt.Fprintf(conn, "OK\n")
+	}
+	out.WriteTo(conn)
+}
+
+type adminCommand struct {
+	Socket string `short:"s" long:"socket" description:"Admin socket path (defaults to admin_socket from the configuration)"`
+}
+
+func (c *adminCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return errors.New("Missing admin command (try 'help')")
+	}
+
+	path := c.Socket
+	if len(path) == 0 {
+		config, err := readConfigFile(opts.Config)
+		if err != nil {
+			return err
+		}
+		path = config.Global.AdminSocket
+	}
+	if len(path) == 0 {
+		return errors.New("No admin socket configured (admin_socket)")
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("Unable to reach the daemon: %v", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "%s\n", strings.Join(args, " "))
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("No answer from the daemon: %v", err)
+	}
+	io.Copy(os.Stdout, r)
+
+	status = strings.TrimSpace(status)
+	if strings.HasPrefix(status, "ERR ") {
+		return errors.New(strings.TrimPrefix(status, "ERR "))
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The agent of the client is used by the bastion to authenticate on the
+// target. It is wrapped in a restrictedAgent which exposes the keys of the
+// agent_keys allowlist of the user, signs until the connection to the target
+// is established, and logs each signature. With onward_agent_forwarding, the
+// agent is also forwarded to the target through a restrictedAgent which
+// signs for the whole session.
+
+var errAgentRestricted = errors.New("agent: operation not permitted by the bastion")
+
+type restrictedAgent struct {
+	agent   agent.ExtendedAgent
+	conn    *BastionConn
+	remote  string
+	allowed []string
+	onward  bool
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func newRestrictedAgent(conn *BastionConn, remote_name string, ag agent.ExtendedAgent) *restrictedAgent {
+	r := &restrictedAgent{agent: ag, conn: conn, remote: remote_name}
+	if user, ok := conn.Config.Users[conn.User()]; ok {
+		r.allowed = user.AgentKeys
+	}
+	return r
+}
+
+// Close ends the handshake with the target, the agent does not sign anymore.
+func (r *restrictedAgent) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+}
+
+func (r *restrictedAgent) permitted(key ssh.PublicKey) bool {
+	return len(r.allowed) == 0 || contains(r.allowed, ssh.FingerprintSHA256(key))
+}
+
+// List returns the keys of the agent within the allowlist.
+func (r *restrictedAgent) List() ([]*agent.Key, error) {
+	keys, err := r.agent.List()
+	if err != nil {
+		return nil, err
+	}
+	permitted := []*agent.Key{}
+	for _, k := range keys {
+		if r.permitted(k) {
+			permitted = append(permitted, k)
+		}
+	}
+	return permitted, nil
+}
+
+func (r *restrictedAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return r.SignWithFlags(key, data, 0)
+}
+
+func (r *restrictedAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	fingerprint := ssh.FingerprintSHA256(key)
+	kind := "agent signature"
+	if r.onward {
+		kind = "onward agent signature"
+	}
+	refuse := func(reason string) (*ssh.Signature, error) {
+		WriteAuthLog("Refused %s with %s %s for %s by %s from %s: %s.", kind, key.Type(), fingerprint, r.remote, r.conn.User(), r.conn.RemoteAddr(), reason)
+		return nil, errAgentRestricted
+	}
+
+	r.lock.Lock()
+	closed := r.closed
+	r.lock.Unlock()
+	if closed {
+		return refuse("session established")
+	}
+	if !r.permitted(key) {
+		return refuse("key not in agent_keys")
+	}
+
+	sig, err := r.agent.SignWithFlags(key, data, flags)
+	if err != nil {
+		WriteAuthLog("Failed %s with %s %s for %s by %s from %s: %v.", kind, key.Type(), fingerprint, r.remote, r.conn.User(), r.conn.RemoteAddr(), err)
+		return nil, err
+	}
+	WriteAuthLog("Accepted %s with %s %s for %s by %s from %s.", kind, key.Type(), fingerprint, r.remote, r.conn.User(), r.conn.RemoteAddr())
+	return sig, nil
+}
+
+// Signers returns signers for the keys of the allowlist, signing through
+// the restrictions of the agent.
+func (r *restrictedAgent) Signers() ([]ssh.Signer, error) {
+	keys, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	signers := []ssh.Signer{}
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, &restrictedAgentSigner{r, pub})
+	}
+	return signers, nil
+}
+
+func (r *restrictedAgent) Add(key agent.AddedKey) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Remove(key ssh.PublicKey) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) RemoveAll() error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Lock(passphrase []byte) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Unlock(passphrase []byte) error {
+	return errAgentRestricted
+}
+
+func (r *restrictedAgent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// ForwardAgent bridges the auth-agent@openssh.com channels opened by the
+// target of client to the agent of the client. It must be called before the
+// auth-agent-req@openssh.com request is sent.
+func ForwardAgent(conn *BastionConn, channel *LogChannel, client *ssh.Client, remote_name string) {
+	channels := client.HandleChannelOpen("auth-agent@openssh.com")
+	go func() {
+		for newChannel := range channels {
+			go forwardAgentChannel(conn, channel, newChannel, remote_name)
+		}
+	}()
+}
+
+func forwardAgentChannel(conn *BastionConn, session *LogChannel, newChannel ssh.NewChannel, remote_name string) {
+	agentChan, agentReqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+	if err != nil {
+		WriteAuthLog("Onward agent forwarding from %s refused by %s from %s: %v.", remote_name, conn.User(), conn.RemoteAddr(), err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer agentChan.Close()
+	go ssh.DiscardRequests(agentReqs)
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	ag := newRestrictedAgent(conn, remote_name, agent.NewClient(agentChan))
+	ag.onward = true
+	start := time.Now()
+	WriteAuthLog("Opened onward agent forwarding from %s by %s from %s.", remote_name, conn.User(), conn.RemoteAddr())
+	session.LogEvent("Agent channel opened", "Target", remote_name)
+
+	agent.ServeAgent(ag, channel)
+	WriteAuthLog("Closed onward agent forwarding from %s by %s from %s: duration %s.", remote_name, conn.User(), conn.RemoteAddr(), time.Since(start).Round(time.Second))
+	session.LogEvent("Agent channel closed", "Target", remote_name)
+}
+
+type restrictedAgentSigner struct {
+	agent *restrictedAgent
+	pub   ssh.PublicKey
+}
+
+func (s *restrictedAgentSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *restrictedAgentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.Sign(s.pub, data)
+}
+
+func (s *restrictedAgentSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if s.pub.Type() != ssh.SigAlgoRSA {
+		return nil, fmt.Errorf("public key must be of type ssh-rsa, but got %v", s.pub.Type())
+	}
+	switch algorithm {
+	case ssh.SigAlgoRSASHA2256:
+		return s.agent.SignWithFlags(s.pub, data, agent.SignatureFlagRsaSha256)
+	case ssh.SigAlgoRSASHA2512:
+		return s.agent.SignWithFlags(s.pub, data, agent.SignatureFlagRsaSha512)
+	}
+	return nil, fmt.Errorf("algorithm not supported")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// RaiseAlert reports an event needing the attention of the administrators.
+// It is written to the daemon log and to syslog, and given on its standard
+// input to alert_command when it is set.
+func RaiseAlert(config *SSHConfig, format string, v ...interface{}) {
+	message := fmt.Sprintf(format, v...)
+	log.Printf("ALERT: %s", message)
+	if authLogger != nil {
+		authLogger.Alert("ALERT: " + message)
+	}
+	if len(config.Global.AlertCommand) == 0 {
+		return
+	}
+	go func() {
+		cmd := exec.Command("/bin/sh", "-c", config.Global.AlertCommand)
+		cmd.Stdin = strings.NewReader(message + "\n")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			log.Printf("Alert command failed: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}()
+}
@@ -2,42 +2,214 @@ package main
 
 import (
 	"fmt"
-	"log"
+	"sort"
 
-	ldap "github.com/go-ldap/ldap"
 	"golang.org/x/crypto/ssh"
 )
 
-func AuthUserPass(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-	perm := &ssh.Permissions{
-		Extensions: map[string]string{
-			"authType": "password",
-			"password": string(password),
-		},
+// Authenticator is an authentication backend. A backend implements one or
+// more of PasswordAuthenticator, PublicKeyAuthenticator and
+// KeyboardInteractiveAuthenticator, depending on the SSH methods it handles.
+type Authenticator interface {
+	Name() string
+}
+
+type PasswordAuthenticator interface {
+	Authenticator
+	AuthPassword(config *SSHConfig, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error)
+}
+
+type PublicKeyAuthenticator interface {
+	Authenticator
+	AuthPublicKey(config *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error)
+}
+
+type KeyboardInteractiveAuthenticator interface {
+	Authenticator
+	AuthKeyboardInteractive(config *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error)
+}
+
+var authenticators = map[string]Authenticator{}
+
+func RegisterAuthenticator(a Authenticator) {
+	authenticators[a.Name()] = a
+}
+
+func AuthenticatorNames() []string {
+	names := []string{}
+	for name := range authenticators {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	if _, ok := config.Users[conn.User()]; !ok {
-		return nil, fmt.Errorf("User Doesn't Exist in Config")
+func init() {
+	RegisterAuthenticator(&publicKeyAuthenticator{})
+	RegisterAuthenticator(&ldapAuthenticator{})
+	RegisterAuthenticator(&fileAuthenticator{})
+	RegisterAuthenticator(&certAuthenticator{})
+	RegisterAuthenticator(&totpAuthenticator{})
+}
+
+// AuthChain returns the names of the backends allowed for user, in the
+// order they are tried: the user's auth list, else the one of its ACL, else
+// cert (when trusted_user_ca_keys is set) and publickey followed by the
+// global auth_type. Users not declared can only log in with a certificate,
+// or through ldap when ldap_group_acls is set, as their ACLs come from the
+// certificate principals or the LDAP groups.
+func (config *SSHConfig) AuthChain(user string) ([]string, error) {
+	chain := []string{}
+	if len(config.Global.TrustedUserCAKeys) > 0 {
+		chain = append(chain, "cert")
+	}
+
+	u, ok := config.Users[user]
+	if !ok {
+		if len(config.Global.LDAP_GroupACLs) > 0 {
+			chain = append(chain, "ldap")
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("User Doesn't Exist in Config")
+		}
+		return chain, nil
+	}
+	if len(u.Auth) > 0 {
+		return u.Auth, nil
+	}
+	if acl, ok := config.ACLs[u.ACL]; ok && len(acl.Auth) > 0 {
+		return acl.Auth, nil
+	}
+
+	chain = append(chain, "publickey")
+	if config.Global.AuthType != "" && config.Global.AuthType != "none" {
+		chain = append(chain, config.Global.AuthType)
+	}
+	return chain, nil
+}
+
+func AuthUserPass(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	conn = withLoginUser(conn)
+	config := currentConfig()
+	if err := limiter.Allowed(config, limiterIP(conn.RemoteAddr()), conn.User()); err != nil {
+		return nil, err
+	}
+	chain, err := config.AuthChain(conn.User())
+	if err != nil {
+		return nil, err
 	}
 
 	if string(password) == "" {
 		return nil, fmt.Errorf("Blank Password Not Allowed")
 	}
 
-	if config.Global.AuthType == "ldap" {
-		l, err := ldap.Dial("tcp", config.Global.LDAP_Server)
-		if err != nil {
-			log.Printf("LDAP Connect Failed: %s", err)
-			return nil, fmt.Errorf("LDAP Connect Failed: %s", err)
+	perm, name, err := authPasswordChain(config, conn, password, chain)
+	if err != nil {
+		return nil, err
+	}
+	if requireTOTP(config, conn.User(), perm) {
+		return nil, fmt.Errorf("Verification code required, use keyboard-interactive")
+	}
+	perm.Extensions["authBackend"] = name
+	return perm, nil
+}
+
+// authPasswordChain tries password against the password backends of chain,
+// and returns the permissions and the name of the first one accepting it.
+func authPasswordChain(config *SSHConfig, conn ssh.ConnMetadata, password []byte, chain []string) (*ssh.Permissions, string, error) {
+	err := fmt.Errorf("No Valid Auth Types")
+	for _, name := range chain {
+		a, ok := authenticators[name].(PasswordAuthenticator)
+		if !ok {
+			continue
+		}
+		perm, authErr := a.AuthPassword(config, conn, password)
+		if authErr == nil {
+			return perm, name, nil
+		}
+		err = authErr
+	}
+	return nil, "", err
+}
+
+func AuthPublicKey(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	conn = withLoginUser(conn)
+	config := currentConfig()
+	chain, err := config.AuthChain(conn.User())
+	if err != nil {
+		return nil, fmt.Errorf("user not found in config for PK")
+	}
+
+	err = fmt.Errorf("No Valid Auth Types")
+	for _, name := range chain {
+		a, ok := authenticators[name].(PublicKeyAuthenticator)
+		if !ok {
+			continue
+		}
+		perm, authErr := a.AuthPublicKey(config, conn, key)
+		if authErr == nil {
+			perm.Extensions["authBackend"] = name
+			if requireTOTP(config, conn.User(), perm) {
+				// Checked on the session channel, see VerifyTOTPSession.
+				perm.Extensions["totpPending"] = "yes"
+			}
+			return perm, nil
 		}
+		err = authErr
+	}
+	return nil, err
+}
 
-		if err := l.Bind(fmt.Sprintf("%s@%s", conn.User(), config.Global.LDAP_Domain), string(password)); err != nil {
-			log.Printf("LDAP Bind Failed: %s", err)
-			return nil, fmt.Errorf("LDAP Bind Failed: %s", err)
+func AuthKeyboardInteractive(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	conn = withLoginUser(conn)
+	config := currentConfig()
+	if err := limiter.Allowed(config, limiterIP(conn.RemoteAddr()), conn.User()); err != nil {
+		return nil, err
+	}
+	chain, err := config.AuthChain(conn.User())
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Global.TOTPSecretsFile) > 0 {
+		chain = appendUnique(chain, "totp")
+	}
+
+	err = fmt.Errorf("No Valid Auth Types")
+	for _, name := range chain {
+		a, ok := authenticators[name].(KeyboardInteractiveAuthenticator)
+		if !ok {
+			continue
+		}
+		perm, authErr := a.AuthKeyboardInteractive(config, conn, client)
+		if authErr == nil {
+			perm.Extensions["authBackend"] = name
+			return perm, nil
 		}
+		err = authErr
+	}
+	return nil, err
+}
 
-		return perm, nil
-	} else {
-		return nil, fmt.Errorf("No Valid Auth Types")
+// KeyboardInteractiveEnabled tells if keyboard-interactive has to be offered
+// to the clients: when TOTP is enabled, or when a keyboard-interactive backend
+// is listed in an auth list.
+func (config *SSHConfig) KeyboardInteractiveEnabled() bool {
+	if len(config.Global.TOTPSecretsFile) > 0 {
+		return true
+	}
+	lists := [][]string{}
+	for _, acl := range config.ACLs {
+		lists = append(lists, acl.Auth)
+	}
+	for _, u := range config.Users {
+		lists = append(lists, u.Auth)
+	}
+	for _, list := range lists {
+		for _, name := range list {
+			if _, ok := authenticators[name].(KeyboardInteractiveAuthenticator); ok {
+				return true
+			}
+		}
 	}
+	return false
 }
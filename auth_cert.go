@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certAuthenticator accepts OpenSSH user certificates signed by one of the
+// trusted_user_ca_keys. The login must match one of the principals of the
+// certificate, either directly or through cert_principal_users.
+type certAuthenticator struct{}
+
+func (a *certAuthenticator) Name() string {
+	return "cert"
+}
+
+func (a *certAuthenticator) AuthPublicKey(config *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("Not a certificate")
+	}
+
+	principal := ""
+	for _, p := range cert.ValidPrincipals {
+		if certPrincipalUser(config, p) == conn.User() {
+			principal = p
+			break
+		}
+	}
+	if len(principal) == 0 {
+		return nil, fmt.Errorf("No certificate principal matches user %s", conn.User())
+	}
+
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("Certificate is not a user certificate")
+	}
+	if !isTrustedUserCA(config, cert.SignatureKey) {
+		return nil, fmt.Errorf("Certificate is not signed by a trusted CA")
+	}
+
+	var revokedErr error
+	checker := &ssh.CertChecker{
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			revoked, err := isCertRevoked(config.Global.RevokedUserCertsFile, cert)
+			if err != nil {
+				// Fail closed when the revocation list can't be read.
+				revokedErr = err
+				return true
+			}
+			return revoked
+		},
+		SupportedCriticalOptions: []string{"source-address"},
+	}
+
+	if err := checker.CheckCert(principal, cert); err != nil {
+		if revokedErr != nil {
+			log.Printf("Unable to read revoked certificates file (%s): %s", config.Global.RevokedUserCertsFile, revokedErr)
+		}
+		return nil, err
+	}
+
+	perm := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions: map[string]string{
+			"authType":   "cert",
+			"certKeyId":  cert.KeyId,
+			"certSerial": strconv.FormatUint(cert.Serial, 10),
+		},
+	}
+	for k, v := range cert.CriticalOptions {
+		perm.CriticalOptions[k] = v
+	}
+
+	acls := []string{}
+	for _, p := range cert.ValidPrincipals {
+		if acl, ok := config.Global.CertPrincipalACLs[p]; ok {
+			acls = appendUnique(acls, acl)
+		}
+	}
+	if _, ok := config.Users[conn.User()]; !ok && len(acls) == 0 {
+		return nil, fmt.Errorf("No ACL granted by certificate principals")
+	}
+	if len(acls) > 0 {
+		perm.Extensions["acls"] = strings.Join(acls, ",")
+	}
+	return perm, nil
+}
+
+func isTrustedUserCA(config *SSHConfig, auth ssh.PublicKey) bool {
+	for _, k := range config.Global.TrustedUserCAKeys {
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(auth.Marshal(), caKey.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// certPrincipalUser returns the bastion user a certificate principal maps to.
+func certPrincipalUser(config *SSHConfig, principal string) string {
+	if user, ok := config.Global.CertPrincipalUsers[principal]; ok {
+		return user
+	}
+	return principal
+}
+
+// isCertRevoked looks cert up in the revocation file. Each line is either
+// "serial:<number>", "id:<key id>", or a public key in authorized_keys format
+// which revokes the certificates of that key or signed by that key.
+func isCertRevoked(filename string, cert *ssh.Certificate) (bool, error) {
+	if len(filename) == 0 {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 0, strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "serial:"):
+			serial, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "serial:")), 10, 64)
+			if err == nil && serial == cert.Serial {
+				return true, nil
+			}
+		case strings.HasPrefix(line, "id:"):
+			if strings.TrimSpace(strings.TrimPrefix(line, "id:")) == cert.KeyId {
+				return true, nil
+			}
+		default:
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(key.Marshal(), cert.Key.Marshal()) || bytes.Equal(key.Marshal(), cert.SignatureKey.Marshal()) {
+				return true, nil
+			}
+		}
+	}
+	return false, scanner.Err()
+}
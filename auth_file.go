@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// fileAuthenticator checks passwords against an htpasswd-like file, one
+// "user:hash" entry per line. Hashes are either bcrypt ($2a$, $2b$, $2y$) or
+// argon2id in the PHC string format ($argon2id$v=19$m=...,t=...,p=...$salt$hash).
+type fileAuthenticator struct{}
+
+func (a *fileAuthenticator) Name() string {
+	return "file"
+}
+
+func (a *fileAuthenticator) AuthPassword(config *SSHConfig, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	entries, err := readUserFile(config.Global.PasswordFile)
+	if err != nil {
+		log.Printf("Unable to read password file (%s): %s", config.Global.PasswordFile, err)
+		return nil, fmt.Errorf("Unable to read password file")
+	}
+
+	hash, ok := entries[conn.User()]
+	if !ok {
+		// Unknown users take as long to refuse as the known ones.
+		checkPasswordHash(dummyPasswordHash(), password)
+		return nil, fmt.Errorf("User has no password in password file")
+	}
+
+	if err := checkPasswordHash(hash, password); err != nil {
+		return nil, err
+	}
+
+	perm := &ssh.Permissions{
+		Extensions: map[string]string{
+			"authType": "password",
+			"password": string(password),
+		},
+	}
+	return perm, nil
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// dummyPasswordHash returns a bcrypt hash checked for the unknown users.
+func dummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = hashPassword("bcrypt", []byte("ssh-bastion dummy password"))
+	})
+	return dummyHash
+}
+
+// readUserFile parses a file of "user:value" lines, such as the password
+// file or the TOTP secrets file.
+func readUserFile(filename string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: missing user name", n)
+		}
+		entries[line[:i]] = line[i+1:]
+	}
+	return entries, scanner.Err()
+}
+
+// Bounds of the argon2id parameters accepted in hashes: argon2.IDKey panics
+// with no pass or thread, and the memory (in KiB) is allocated on each login.
+const (
+	argon2idMinTime   = 1
+	argon2idMinThread = 1
+	argon2idMaxMemory = 1024 * 1024
+)
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2idHash(hash string) (*argon2idHash, error) {
+	var version int
+	h := &argon2idHash{}
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("Invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("Unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("Invalid argon2id parameters")
+	}
+	if h.time < argon2idMinTime || h.threads < argon2idMinThread {
+		return nil, fmt.Errorf("Invalid argon2id parameters: t and p must be at least 1")
+	}
+	if h.memory < 8*uint32(h.threads) || h.memory > argon2idMaxMemory {
+		return nil, fmt.Errorf("Invalid argon2id parameters: m must be between %d and %d", 8*uint32(h.threads), argon2idMaxMemory)
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("Invalid argon2id salt")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("Invalid argon2id hash")
+	}
+	return h, nil
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// validatePasswordHash checks the format of hash without computing it.
+func validatePasswordHash(hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2idHash(hash)
+		return err
+	default:
+		return fmt.Errorf("Unsupported password hash")
+	}
+}
+
+func checkPasswordHash(hash string, password []byte) error {
+	switch {
+	case isBcryptHash(hash):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), password); err != nil {
+			return fmt.Errorf("Password Mismatch")
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		h, err := parseArgon2idHash(hash)
+		if err != nil {
+			return err
+		}
+		computed := argon2.IDKey(password, h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+		if subtle.ConstantTimeCompare(computed, h.key) != 1 {
+			return fmt.Errorf("Password Mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported password hash")
+	}
+}
+
+func hashPassword(algorithm string, password []byte) (string, error) {
+	switch algorithm {
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		return string(hash), err
+	case "argon2id":
+		var memory, time uint32 = 64 * 1024, 3
+		var threads uint8 = 2
+
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey(password, salt, time, memory, threads, 32)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, memory, time, threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("Unknown hash algorithm %s", algorithm)
+	}
+}
+
+// setUserFileEntry creates or replaces the entry of user in a file read by
+// readUserFile, keeping the other lines untouched. The file is replaced
+// atomically.
+func setUserFileEntry(filename string, user string, value string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := []string{}
+	found := false
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			if strings.HasPrefix(line, user+":") {
+				line = user + ":" + value
+				found = true
+			}
+			lines = append(lines, line)
+		}
+	}
+	if !found {
+		lines = append(lines, user+":"+value)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.WriteString(strings.Join(lines, "\n") + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+type passwdCommand struct {
+	File      string `short:"f" long:"file" description:"Password file (defaults to password_file from the configuration)"`
+	Algorithm string `short:"a" long:"algorithm" description:"Hash algorithm" choice:"bcrypt" choice:"argon2id" default:"bcrypt"`
+}
+
+func (c *passwdCommand) Execute(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: passwd <user>")
+	}
+	user := args[0]
+	if len(user) == 0 || strings.ContainsAny(user, ":\n") {
+		return fmt.Errorf("Invalid user name %q", user)
+	}
+
+	filename := c.File
+	if len(filename) == 0 {
+		config, err := readConfigFile(opts.Config)
+		if err != nil {
+			return err
+		}
+		filename = config.Global.PasswordFile
+	}
+	if len(filename) == 0 {
+		return errors.New("No password file configured (password_file)")
+	}
+
+	var password []byte
+	if terminal.IsTerminal(syscall.Stdin) {
+		fmt.Printf("New password for %s: ", user)
+		p1, err := terminal.ReadPassword(syscall.Stdin)
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Retype new password: ")
+		p2, err := terminal.ReadPassword(syscall.Stdin)
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(p1, p2) {
+			return errors.New("Passwords don't match")
+		}
+		password = p1
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && len(line) == 0 {
+			return fmt.Errorf("Unable to read password from stdin: %v", err)
+		}
+		password = []byte(strings.TrimRight(line, "\r\n"))
+	}
+	if len(password) == 0 {
+		return errors.New("Blank Password Not Allowed")
+	}
+
+	hash, err := hashPassword(c.Algorithm, password)
+	if err != nil {
+		return err
+	}
+	if err := setUserFileEntry(filename, user, hash); err != nil {
+		return fmt.Errorf("Unable to update password file %s: %v", filename, err)
+	}
+	fmt.Printf("Password of %s updated in %s\n", user, filename)
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	ldap "github.com/go-ldap/ldap"
+	"golang.org/x/crypto/ssh"
+)
+
+// ldapAuthenticator checks passwords with a bind on the LDAP server, either
+// directly as <user>@ldap_domain (AD), or on the DN found with the service
+// account (search-then-bind).
+type ldapAuthenticator struct{}
+
+func (a *ldapAuthenticator) Name() string {
+	return "ldap"
+}
+
+func (a *ldapAuthenticator) AuthPassword(config *SSHConfig, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	perm := &ssh.Permissions{
+		Extensions: map[string]string{
+			"authType": "password",
+			"password": string(password),
+		},
+	}
+
+	var groupACLs []string
+	err := ldapPool.withConn(config, func(l *ldap.Conn) error {
+		dn, err := ldapUserDN(config, l, conn.User())
+		if err != nil {
+			return err
+		}
+
+		if err := l.Bind(dn, string(password)); err != nil {
+			log.Printf("LDAP Bind Failed: %s", err)
+			return fmt.Errorf("LDAP Bind Failed: %s", err)
+		}
+
+		if len(config.Global.LDAP_GroupACLs) > 0 {
+			acls, err := ldapGroupACLs(config, l, conn.User())
+			if err != nil {
+				log.Printf("LDAP group lookup failed for user %s: %s", conn.User(), err)
+				return err
+			}
+			groupACLs = acls
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := config.Users[conn.User()]; !ok && len(groupACLs) == 0 {
+		return nil, fmt.Errorf("No ACL granted by LDAP groups")
+	}
+	if len(groupACLs) > 0 {
+		perm.Extensions["acls"] = strings.Join(groupACLs, ",")
+	}
+
+	return perm, nil
+}
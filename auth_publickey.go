@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// publicKeyAuthenticator checks public keys against the authorized_key or
+// authorized_keys_file of the user.
+type publicKeyAuthenticator struct{}
+
+func (a *publicKeyAuthenticator) Name() string {
+	return "publickey"
+}
+
+func (a *publicKeyAuthenticator) AuthPublicKey(config *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	user, ok := config.Users[conn.User()]
+	if !ok {
+		return nil, fmt.Errorf("user not found in config for PK")
+	}
+
+	var authKeysData []byte
+	if len(user.AuthorizedKeyStr) > 0 {
+		authKeysData = []byte(user.AuthorizedKeyStr)
+	} else if len(user.AuthorizedKeysFile) > 0 {
+		var err error
+		authKeysData, err = ioutil.ReadFile(user.AuthorizedKeysFile)
+		if err != nil {
+			log.Printf("Unable to read authorized keys file (%s) for user (%s): %s.", user.AuthorizedKeysFile, conn.User(), err)
+			return nil, fmt.Errorf("Unable to read Authorized Keys file.")
+		}
+	} else {
+		return nil, fmt.Errorf("User has no authorized keys specified.")
+	}
+
+	for len(authKeysData) > 0 {
+		var authKey ssh.PublicKey
+		var options []string
+		var err error
+		authKey, _, options, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
+		if err != nil {
+			log.Printf("Error while processing authorized keys for user (%s): %s.", conn.User(), err)
+			return nil, fmt.Errorf("Error while processing authorized keys file.")
+		}
+
+		if (key.Type() == authKey.Type()) && (bytes.Compare(key.Marshal(), authKey.Marshal()) == 0) {
+			keyOpts, err := parseKeyOptions(options)
+			if err != nil {
+				log.Printf("Ignored authorized key of user (%s) with invalid options: %s.", conn.User(), err)
+				continue
+			}
+			if err := keyOpts.Check(conn.RemoteAddr(), time.Now()); err != nil {
+				return nil, err
+			}
+
+			perm := &ssh.Permissions{
+				Extensions: map[string]string{
+					"authType": "pk",
+				},
+			}
+			keyOpts.SetExtensions(perm.Extensions)
+			return perm, nil
+		}
+	}
+	return nil, fmt.Errorf("No PKs Match - ACCESS DENIED")
+}
+
+// keyOptions holds the options of an authorized key, see the AUTHORIZED_KEYS
+// FILE FORMAT section of sshd(8). Host names in from= are not resolved, the
+// patterns are matched against the client address only.
+type keyOptions struct {
+	From              []string
+	ExpiryTime        time.Time
+	Command           string
+	PermitOpen        []string
+	NoAgentForwarding bool
+	NoPortForwarding  bool
+	NoPty             bool
+	NoX11Forwarding   bool
+}
+
+// Options accepted in authorized keys without any effect on the bastion.
+var ignoredKeyOptions = map[string]bool{
+	"environment":       true,
+	"no-user-rc":        true,
+	"permit-user-rc":    true,
+	"user-rc":           true,
+	"no-touch-required": true,
+	"verify-required":   true,
+}
+
+func parseKeyOptions(options []string) (*keyOptions, error) {
+	o := &keyOptions{}
+	for _, option := range options {
+		name, value := option, ""
+		if i := strings.Index(option, "="); i >= 0 {
+			name = option[:i]
+			value = option[i+1:]
+			if len(value) < 2 || !strings.HasPrefix(value, "\"") || !strings.HasSuffix(value, "\"") {
+				return nil, fmt.Errorf("invalid value of option %s", name)
+			}
+			value = strings.Replace(value[1:len(value)-1], "\\\"", "\"", -1)
+		}
+
+		switch strings.ToLower(name) {
+		case "from":
+			for _, pattern := range strings.Split(value, ",") {
+				if strings.Contains(pattern, "/") {
+					if _, _, err := net.ParseCIDR(strings.TrimPrefix(pattern, "!")); err != nil {
+						return nil, fmt.Errorf("invalid from pattern %q", pattern)
+					}
+				}
+				o.From = append(o.From, pattern)
+			}
+		case "expiry-time":
+			t, err := parseExpiryTime(value)
+			if err != nil {
+				return nil, err
+			}
+			o.ExpiryTime = t
+		case "command":
+			o.Command = value
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("invalid permitopen %q", value)
+			}
+			o.PermitOpen = append(o.PermitOpen, value)
+		case "restrict":
+			o.NoAgentForwarding = true
+			o.NoPortForwarding = true
+			o.NoPty = true
+			o.NoX11Forwarding = true
+		case "no-agent-forwarding":
+			o.NoAgentForwarding = true
+		case "agent-forwarding":
+			o.NoAgentForwarding = false
+		case "no-port-forwarding":
+			o.NoPortForwarding = true
+		case "port-forwarding":
+			o.NoPortForwarding = false
+		case "no-pty":
+			o.NoPty = true
+		case "pty":
+			o.NoPty = false
+		case "no-x11-forwarding":
+			o.NoX11Forwarding = true
+		case "x11-forwarding":
+			o.NoX11Forwarding = false
+		default:
+			if !ignoredKeyOptions[strings.ToLower(name)] {
+				return nil, fmt.Errorf("unsupported option %s", name)
+			}
+		}
+	}
+	return o, nil
+}
+
+// parseExpiryTime parses YYYYMMDD[HHMM[SS]], in the local time zone unless
+// the date ends with Z.
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(value, "Z") {
+		loc = time.UTC
+		value = strings.TrimSuffix(value, "Z")
+	}
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	if layout, ok := layouts[len(value)]; ok {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+}
+
+// Check refuses keys used past their expiry time or from an address not
+// matching the from= patterns.
+func (o *keyOptions) Check(addr net.Addr, now time.Time) error {
+	if !o.ExpiryTime.IsZero() && now.After(o.ExpiryTime) {
+		return fmt.Errorf("Authorized key expired")
+	}
+	if len(o.From) == 0 {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	matched := false
+	for _, pattern := range o.From {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		match := false
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			match = ip != nil && network.Contains(ip)
+		} else {
+			match, _ = path.Match(pattern, host)
+		}
+		if match && negated {
+			return fmt.Errorf("Authorized key not allowed from %s", host)
+		}
+		matched = matched || match
+	}
+	if !matched {
+		return fmt.Errorf("Authorized key not allowed from %s", host)
+	}
+	return nil
+}
+
+// SetExtensions stores the restrictions in the permissions of the
+// connection, for SessionForward to apply them.
+func (o *keyOptions) SetExtensions(ext map[string]string) {
+	if len(o.Command) > 0 {
+		ext["forceCommand"] = o.Command
+	}
+	if len(o.PermitOpen) > 0 {
+		ext["permitOpen"] = strings.Join(o.PermitOpen, ",")
+	}
+	flags := map[string]bool{
+		"noAgentForwarding": o.NoAgentForwarding,
+		"noPortForwarding":  o.NoPortForwarding,
+		"noPty":             o.NoPty,
+		"noX11Forwarding":   o.NoX11Forwarding,
+	}
+	for name, set := range flags {
+		if set {
+			ext[name] = "yes"
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Time-based one-time codes as described in RFC 6238: HMAC-SHA1, 30 seconds
+// steps and 6 digits, which is what authenticator applications expect from
+// an otpauth:// URI without parameters.
+const (
+	totpPeriod      = 30
+	totpDigits      = 6
+	totpSkew        = 1
+	totpMaxAttempts = 3
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpLastStep remembers the last time step accepted for each user, so a
+// code can't be used twice.
+var (
+	totpLastStep = map[string]uint64{}
+	totpLock     sync.Mutex
+)
+
+// totpAuthenticator implements keyboard-interactive as a password, checked
+// against the password backends of the user's chain, followed by a
+// verification code when one of the user's ACLs has require_totp. Users
+// without a secret in totp_secrets_file are enrolled on their first login.
+type totpAuthenticator struct{}
+
+func (a *totpAuthenticator) Name() string {
+	return "totp"
+}
+
+func (a *totpAuthenticator) AuthKeyboardInteractive(config *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	chain, err := config.AuthChain(conn.User())
+	if err != nil {
+		return nil, err
+	}
+
+	answers, err := client("", "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 || len(answers[0]) == 0 {
+		return nil, fmt.Errorf("Blank Password Not Allowed")
+	}
+
+	perm, _, err := authPasswordChain(config, conn, []byte(answers[0]), chain)
+	if err != nil {
+		return nil, err
+	}
+	if !requireTOTP(config, conn.User(), perm) {
+		return perm, nil
+	}
+
+	secret, enrolled, err := userTOTPSecret(config, conn.User())
+	if err != nil {
+		return nil, err
+	}
+	instruction := ""
+	if !enrolled {
+		instruction = totpEnrollInstruction(config, conn.User(), secret)
+	}
+	answers, err = client(conn.User(), instruction, []string{"Verification code: "}, []bool{true})
+	if err != nil {
+		return nil, err
+	}
+	if len(answers) != 1 {
+		return nil, fmt.Errorf("Missing verification code")
+	}
+	if err := confirmTOTP(config, conn.User(), secret, enrolled, answers[0]); err != nil {
+		return nil, err
+	}
+	perm.Extensions["totp"] = "verified"
+	return perm, nil
+}
+
+// requireTOTP tells if one of the ACLs of an authenticated user requires a
+// verification code.
+func requireTOTP(config *SSHConfig, user string, perms *ssh.Permissions) bool {
+	acl, ok := config.ResolveACL(config.UserACLs(user, perms))
+	return ok && acl.RequireTOTP
+}
+
+// VerifyTOTPSession asks for a verification code on the session channel. It is
+// used after publickey or cert authentication, as the SSH server can't chain
+// authentication methods.
+func VerifyTOTPSession(config *SSHConfig, channel io.ReadWriter, conn ssh.ConnMetadata) error {
+	secret, enrolled, err := userTOTPSecret(config, conn.User())
+	if err != nil {
+		AuthLog(conn, "totp", err)
+		return err
+	}
+	if !enrolled {
+		fmt.Fprintf(channel, "%s\r\n", strings.Replace(totpEnrollInstruction(config, conn.User(), secret), "\n", "\r\n", -1))
+	}
+
+	t := terminal.NewTerminal(channel, "")
+	for i := 0; i < totpMaxAttempts; i++ {
+		if err := limiter.Allowed(config, limiterIP(conn.RemoteAddr()), conn.User()); err != nil {
+			return err
+		}
+		var code string
+		code, err = t.ReadPassword("Verification code: ")
+		if err != nil {
+			AuthLog(conn, "totp", err)
+			return err
+		}
+		err = confirmTOTP(config, conn.User(), secret, enrolled, code)
+		AuthLog(conn, "totp", err)
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(channel, "Invalid verification code.\r\n")
+	}
+	return err
+}
+
+// userTOTPSecret returns the secret of user, or a new one when the user is not
+// enrolled yet.
+func userTOTPSecret(config *SSHConfig, user string) (string, bool, error) {
+	secrets, err := readUserFile(config.Global.TOTPSecretsFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Unable to read TOTP secrets file (%s): %s", config.Global.TOTPSecretsFile, err)
+		return "", false, fmt.Errorf("Unable to read TOTP secrets file")
+	}
+	if secret, ok := secrets[user]; ok {
+		return secret, true, nil
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", false, err
+	}
+	return totpEncoding.EncodeToString(key), false, nil
+}
+
+// confirmTOTP checks code against secret, and saves the secret of a user
+// being enrolled once a first code is valid.
+func confirmTOTP(config *SSHConfig, user string, secret string, enrolled bool, code string) error {
+	if err := checkTOTPCode(user, secret, strings.TrimSpace(code), time.Now()); err != nil {
+		return err
+	}
+	if enrolled {
+		return nil
+	}
+
+	totpLock.Lock()
+	defer totpLock.Unlock()
+	if err := setUserFileEntry(config.Global.TOTPSecretsFile, user, secret); err != nil {
+		log.Printf("Unable to update TOTP secrets file (%s): %s", config.Global.TOTPSecretsFile, err)
+		return fmt.Errorf("Unable to save TOTP secret")
+	}
+	WriteAuthLog("TOTP secret enrolled for user %s.", user)
+	return nil
+}
+
+func totpEnrollInstruction(config *SSHConfig, user string, secret string) string {
+	return fmt.Sprintf("Two-factor authentication is required for %s.\n"+
+		"Add this account to your authenticator application, then enter the code it displays:\n"+
+		"  %s\n"+
+		"Secret key: %s", user, totpURI(config, user, secret), secret)
+}
+
+func totpURI(config *SSHConfig, user string, secret string) string {
+	issuer := config.Global.TOTPIssuer
+	if len(issuer) == 0 {
+		issuer = "ssh-bastion"
+	}
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%d", totpDigits))
+	v.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s:%s?%s", url.PathEscape(issuer), url.PathEscape(user), v.Encode())
+}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("Invalid TOTP secret")
+	}
+	return key, nil
+}
+
+// checkTOTPCode accepts the codes of the current time step and of the
+// adjacent ones, to allow for clock drift.
+func checkTOTPCode(user string, secret string, code string, now time.Time) error {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return err
+	}
+	if len(code) != totpDigits {
+		return fmt.Errorf("Invalid verification code")
+	}
+
+	current := uint64(now.Unix()) / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if !hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			continue
+		}
+
+		totpLock.Lock()
+		defer totpLock.Unlock()
+		if step <= totpLastStep[user] {
+			return fmt.Errorf("Verification code already used")
+		}
+		totpLastStep[user] = step
+		return nil
+	}
+	return fmt.Errorf("Invalid verification code")
+}
+
+func totpCode(key []byte, step uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ConfigDiagnostic is a problem found in a configuration file. Path is the
+// key path of the faulty directive inside File (e.g. users.julien.acl).
+// Tolerated errors only affect a user or a server, or have a fallback: the
+// daemon starts anyway and logs them as warnings, so one bad entry doesn't
+// lock everyone out.
+type ConfigDiagnostic struct {
+	Severity  string
+	File      string
+	Path      string
+	Message   string
+	Tolerated bool
+}
+
+func (d ConfigDiagnostic) String() string {
+	if len(d.Path) == 0 {
+		return fmt.Sprintf("%s: %s: %s", d.File, d.Severity, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s: %s", d.File, d.Path, d.Severity, d.Message)
+}
+
+type ConfigDiagnostics []ConfigDiagnostic
+
+func (diags *ConfigDiagnostics) Errorf(file string, path string, format string, v ...interface{}) {
+	*diags = append(*diags, ConfigDiagnostic{Severity: SeverityError, File: file, Path: path, Message: fmt.Sprintf(format, v...)})
+}
+
+// ToleratedErrorf records an error the daemon only logs as a warning.
+func (diags *ConfigDiagnostics) ToleratedErrorf(file string, path string, format string, v ...interface{}) {
+	*diags = append(*diags, ConfigDiagnostic{Severity: SeverityError, File: file, Path: path, Message: fmt.Sprintf(format, v...), Tolerated: true})
+}
+
+func (diags *ConfigDiagnostics) Warnf(file string, path string, format string, v ...interface{}) {
+	*diags = append(*diags, ConfigDiagnostic{Severity: SeverityWarning, File: file, Path: path, Message: fmt.Sprintf(format, v...)})
+}
+
+// Count returns the number of errors and warnings.
+func (diags ConfigDiagnostics) Count() (int, int) {
+	errs, warnings := 0, 0
+	for _, d := range diags {
+		if d.Severity == SeverityError {
+			errs++
+		} else {
+			warnings++
+		}
+	}
+	return errs, warnings
+}
+
+// Daemon returns the diagnostics as the daemon sees them, the tolerated
+// errors being warnings.
+func (diags ConfigDiagnostics) Daemon() ConfigDiagnostics {
+	out := make(ConfigDiagnostics, len(diags))
+	for i, d := range diags {
+		if d.Tolerated {
+			d.Severity = SeverityWarning
+		}
+		out[i] = d
+	}
+	return out
+}
+
+// Err returns the first error, or nil if there are only warnings.
+func (diags ConfigDiagnostics) Err() error {
+	errs, _ := diags.Count()
+	for _, d := range diags {
+		if d.Severity != SeverityError {
+			continue
+		}
+		if errs > 1 {
+			return fmt.Errorf("%s (and %d more errors)", d, errs-1)
+		}
+		return errors.New(d.String())
+	}
+	return nil
+}
+
+// checkUnknownFields parses the file again in strict mode, to report the
+// directives which are not known and silently ignored.
+func (diags *ConfigDiagnostics) checkUnknownFields(file string, out interface{}) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	if err := yaml.UnmarshalStrict(data, out); err != nil {
+		if typeErr, ok := err.(*yaml.TypeError); ok {
+			for _, e := range typeErr.Errors {
+				diags.Warnf(file, "", "%s", e)
+			}
+		}
+	}
+}
+
+// checkConfig reports the inconsistencies of a loaded configuration.
+// definedIn gives the file declaring each server.
+func checkConfig(config *SSHConfig, filename string, definedIn map[string]string, diags *ConfigDiagnostics) {
+	serverPath := func(name string, key string) (string, string) {
+		if file, ok := definedIn[name]; ok && file != filename {
+			return file, name + "." + key
+		}
+		return filename, "servers." + name + "." + key
+	}
+
+	if len(config.Global.ListenPath) == 0 {
+		diags.ToleratedErrorf(filename, "global.listen_path", "No listen path defined")
+	}
+	if len(config.Global.BastionPrivateKeys) == 0 {
+		diags.Errorf(filename, "global.bastion_private_keys", "No bastion private key defined")
+	}
+	for i, k := range config.Global.BastionPrivateKeys {
+		if len(k) == 0 {
+			continue
+		}
+		if _, err := ssh.ParsePrivateKey([]byte(k)); err != nil {
+			diags.Errorf(filename, fmt.Sprintf("global.bastion_private_keys[%d]", i), "Invalid private key: %v", err)
+		}
+	}
+	if len(config.Groups) > 0 && len(config.Global.GroupPath) == 0 {
+		diags.Warnf(filename, "global.group_path", "No group path defined, group files are looked up from /")
+	}
+	if len(config.Global.LogPath) == 0 {
+		diags.Warnf(filename, "global.log_path", "No log path defined, session logs are written from /")
+	}
+	if len(config.Global.MOTDPath) > 0 {
+		if _, err := os.Stat(config.Global.MOTDPath); err != nil {
+			diags.Warnf(filename, "global.motd_path", "Unable to read MOTD file: %v", err)
+		}
+	}
+	if len(config.Global.ConnectTimeout) > 0 {
+		if _, err := time.ParseDuration(config.Global.ConnectTimeout); err != nil {
+			diags.Errorf(filename, "global.connect_timeout", "Invalid timeout: %v", err)
+		}
+	}
+	switch config.Global.AuthType {
+	case "", "none":
+	default:
+		if _, ok := authenticators[config.Global.AuthType].(PasswordAuthenticator); !ok {
+			diags.Errorf(filename, "global.auth_type", "Unknown auth type %q", config.Global.AuthType)
+		}
+	}
+
+	backends := make(map[string]bool)
+	checkAuth := func(path string, names []string) {
+		for i, n := range names {
+			if _, ok := authenticators[n]; !ok {
+				diags.Errorf(filename, fmt.Sprintf("%s[%d]", path, i), "Unknown auth backend %q (available: %s)", n, strings.Join(AuthenticatorNames(), ", "))
+			}
+		}
+	}
+	for name, acl := range config.ACLs {
+		checkAuth("acls."+name+".auth", acl.Auth)
+	}
+	for name, user := range config.Users {
+		checkAuth("users."+name+".auth", user.Auth)
+		if chain, err := config.AuthChain(name); err == nil {
+			for _, n := range chain {
+				backends[n] = true
+			}
+		}
+	}
+	if len(config.Global.LDAP_GroupACLs) > 0 {
+		backends["ldap"] = true
+		for group, acl := range config.Global.LDAP_GroupACLs {
+			if _, ok := config.ACLs[acl]; !ok {
+				diags.Errorf(filename, "global.ldap_group_acls."+group, "ACL %q is not defined", acl)
+			}
+		}
+		if len(config.Global.LDAP_BaseDN) == 0 {
+			diags.Errorf(filename, "global.ldap_base_dn", "No base DN defined for the LDAP group lookup")
+		}
+		if len(config.Global.LDAP_GroupFilter) > 0 && !strings.Contains(config.Global.LDAP_GroupFilter, "{dn}") {
+			diags.Errorf(filename, "global.ldap_group_filter", "The filter doesn't contain {dn}")
+		}
+	}
+	if backends["ldap"] {
+		servers := ldapServers(config)
+		if len(servers) == 0 {
+			diags.Errorf(filename, "global.ldap_servers", "No LDAP server defined for the ldap auth backend")
+		}
+		cleartext := false
+		for i, server := range servers {
+			scheme, _, err := parseLDAPServer(server)
+			if err != nil {
+				diags.Errorf(filename, fmt.Sprintf("global.ldap_servers[%d]", i), "Invalid LDAP server: %v", err)
+			} else if scheme == "ldap" && !config.Global.LDAP_StartTLS {
+				cleartext = true
+			}
+		}
+		if cleartext {
+			diags.Warnf(filename, "global.ldap_starttls", "LDAP passwords are sent in cleartext, use ldaps:// servers or enable ldap_starttls")
+		}
+		if len(config.Global.LDAP_CAFile) > 0 {
+			if _, err := ldapTLSConfig(config, ""); err != nil {
+				diags.Errorf(filename, "global.ldap_ca_file", "%v", err)
+			}
+		}
+		if len(config.Global.LDAP_ConnectTimeout) > 0 {
+			if _, err := time.ParseDuration(config.Global.LDAP_ConnectTimeout); err != nil {
+				diags.Errorf(filename, "global.ldap_connect_timeout", "Invalid timeout: %v", err)
+			}
+		}
+		if len(config.Global.LDAP_BindDN) > 0 {
+			if len(config.Global.LDAP_BaseDN) == 0 {
+				diags.Errorf(filename, "global.ldap_base_dn", "No base DN defined for the LDAP user search")
+			}
+			if len(config.Global.LDAP_BindPassword) == 0 {
+				diags.Errorf(filename, "global.ldap_bind_password", "No password defined for the LDAP service account")
+			}
+			if len(config.Global.LDAP_UserFilter) > 0 && !strings.Contains(config.Global.LDAP_UserFilter, "{username}") {
+				diags.Errorf(filename, "global.ldap_user_filter", "The filter doesn't contain {username}")
+			}
+		} else if len(config.Global.LDAP_Domain) == 0 {
+			diags.Warnf(filename, "global.ldap_domain", "No LDAP domain defined for the ldap auth backend")
+		}
+	}
+	for i, k := range config.Global.TrustedUserCAKeys {
+		if len(k) == 0 {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			diags.Errorf(filename, fmt.Sprintf("global.trusted_user_ca_keys[%d]", i), "Invalid CA public key: %v", err)
+		}
+	}
+	if len(config.Global.RevokedUserCertsFile) > 0 {
+		if _, err := ioutil.ReadFile(config.Global.RevokedUserCertsFile); err != nil {
+			diags.Errorf(filename, "global.revoked_user_certs_file", "Unable to read revoked certificates file, all certificates will be refused: %v", err)
+		}
+	}
+	for i, k := range config.Global.TrustedHostCAKeys {
+		if len(k) == 0 {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+			diags.Errorf(filename, fmt.Sprintf("global.trusted_host_ca_keys[%d]", i), "Invalid CA public key: %v", err)
+		}
+	}
+	for group, keys := range config.Global.GroupTrustedHostCAKeys {
+		if !contains(config.Groups, group) {
+			diags.Warnf(filename, "global.group_trusted_host_ca_keys."+group, "Group %q is not declared in groups", group)
+		}
+		for i, k := range keys {
+			if len(k) == 0 {
+				continue
+			}
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+				diags.Errorf(filename, fmt.Sprintf("global.group_trusted_host_ca_keys.%s[%d]", group, i), "Invalid CA public key: %v", err)
+			}
+		}
+	}
+	if len(config.Global.RevokedHostCertsFile) > 0 {
+		if _, err := ioutil.ReadFile(config.Global.RevokedHostCertsFile); err != nil {
+			diags.Errorf(filename, "global.revoked_host_certs_file", "Unable to read revoked certificates file, all host certificates will be refused: %v", err)
+		}
+	}
+	for principal, acl := range config.Global.CertPrincipalACLs {
+		if _, ok := config.ACLs[acl]; !ok {
+			diags.Errorf(filename, "global.cert_principal_acls."+principal, "ACL %q is not defined", acl)
+		}
+	}
+	if len(config.Global.TrustedUserCAKeys) == 0 && (len(config.Global.CertPrincipalACLs) > 0 || len(config.Global.CertPrincipalUsers) > 0) {
+		diags.Warnf(filename, "global.trusted_user_ca_keys", "No trusted user CA defined, certificate principal mappings are unused")
+	}
+	if backends["file"] {
+		if len(config.Global.PasswordFile) == 0 {
+			diags.Errorf(filename, "global.password_file", "No password file defined for the file auth backend")
+		} else if entries, err := readUserFile(config.Global.PasswordFile); err != nil {
+			diags.Errorf(filename, "global.password_file", "Unable to read password file: %v", err)
+		} else {
+			for user, hash := range entries {
+				if err := validatePasswordHash(hash); err != nil {
+					diags.ToleratedErrorf(config.Global.PasswordFile, user, "%v", err)
+				}
+			}
+			if fi, err := os.Stat(config.Global.PasswordFile); err == nil && fi.Mode().Perm()&0077 != 0 {
+				diags.Warnf(filename, "global.password_file", "Password file is readable by other users (mode %04o)", fi.Mode().Perm())
+			}
+		}
+	}
+
+	requireTOTP := false
+	for name, acl := range config.ACLs {
+		if acl.RequireTOTP {
+			requireTOTP = true
+			if len(config.Global.TOTPSecretsFile) == 0 {
+				diags.Errorf(filename, "acls."+name+".require_totp", "No TOTP secrets file defined (totp_secrets_file)")
+			}
+		}
+	}
+	if backends["totp"] && len(config.Global.TOTPSecretsFile) == 0 {
+		diags.Errorf(filename, "global.totp_secrets_file", "No TOTP secrets file defined for the totp auth backend")
+	}
+	if len(config.Global.TOTPSecretsFile) > 0 {
+		if !requireTOTP {
+			diags.Warnf(filename, "global.totp_secrets_file", "No ACL sets require_totp, verification codes are never asked")
+		}
+		if entries, err := readUserFile(config.Global.TOTPSecretsFile); os.IsNotExist(err) {
+			if fi, err := os.Stat(filepath.Dir(config.Global.TOTPSecretsFile)); err != nil || !fi.IsDir() {
+				diags.Errorf(filename, "global.totp_secrets_file", "Directory of the TOTP secrets file doesn't exist")
+			}
+		} else if err != nil {
+			diags.Errorf(filename, "global.totp_secrets_file", "Unable to read TOTP secrets file: %v", err)
+		} else {
+			for user, secret := range entries {
+				if _, err := decodeTOTPSecret(secret); err != nil {
+					diags.ToleratedErrorf(config.Global.TOTPSecretsFile, user, "%v", err)
+				}
+			}
+			if fi, err := os.Stat(config.Global.TOTPSecretsFile); err == nil && fi.Mode().Perm()&0077 != 0 {
+				diags.Warnf(filename, "global.totp_secrets_file", "TOTP secrets file is readable by other users (mode %04o)", fi.Mode().Perm())
+			}
+		}
+	}
+
+	if len(config.Global.BanTime) > 0 {
+		if d, err := time.ParseDuration(config.Global.BanTime); err != nil || d <= 0 {
+			diags.Errorf(filename, "global.ban_time", "Invalid ban time %q, the default of %s is used", config.Global.BanTime, defaultBanTime)
+		}
+	}
+	if config.Global.HostKeyTOFU && len(config.Global.StoragePath) == 0 {
+		diags.Errorf(filename, "global.host_key_tofu", "No storage directory defined for the known hosts (storage_path)")
+	}
+	for i, ip := range config.Global.BanIgnoreIPs {
+		if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+			diags.Errorf(filename, fmt.Sprintf("global.ban_ignore_ips[%d]", i), "Invalid IP address or CIDR %q", ip)
+		}
+	}
+
+	for name, server := range config.Servers {
+		if len(server.ConnectPath) > 0 && len(server.ConnectPaths) > 0 {
+			file, path := serverPath(name, "connect_paths")
+			diags.ToleratedErrorf(file, path, "connect_path and connect_paths can't be both defined")
+		} else if len(server.ConnectPath) == 0 && len(server.ConnectPaths) == 0 {
+			file, path := serverPath(name, "connect_path")
+			diags.ToleratedErrorf(file, path, "No connect path defined")
+		} else if _, _, err := net.SplitHostPort(server.ConnectPath); len(server.ConnectPath) > 0 && err != nil {
+			file, path := serverPath(name, "connect_path")
+			diags.ToleratedErrorf(file, path, "Invalid connect path: %v", err)
+		}
+		for i, p := range server.ConnectPaths {
+			if _, _, err := net.SplitHostPort(p); err != nil {
+				file, path := serverPath(name, fmt.Sprintf("connect_paths[%d]", i))
+				diags.ToleratedErrorf(file, path, "Invalid connect path: %v", err)
+			}
+		}
+		if len(server.ConnectOrder) > 0 && server.ConnectOrder != connectOrdered && server.ConnectOrder != connectRandom {
+			file, path := serverPath(name, "connect_order")
+			diags.ToleratedErrorf(file, path, "Invalid connect order %q (expected %s or %s)", server.ConnectOrder, connectOrdered, connectRandom)
+		}
+		if len(server.ConnectAttemptTimeout) > 0 {
+			if _, err := time.ParseDuration(server.ConnectAttemptTimeout); err != nil {
+				file, path := serverPath(name, "connect_attempt_timeout")
+				diags.ToleratedErrorf(file, path, "Invalid timeout: %v", err)
+			}
+		}
+		if (len(server.ConnectOrder) > 0 || server.HappyEyeballs) && len(server.ConnectPaths) < 2 {
+			file, path := serverPath(name, "connect_paths")
+			diags.Warnf(file, path, "connect_order and happy_eyeballs are ignored with a single connect path")
+		}
+		if len(server.HostPubKeys) == 0 && !config.Global.IgnoreHostPubKeys && !config.Global.HostKeyTOFU && len(hostCAKeys(config, server)) == 0 {
+			file, path := serverPath(name, "host_pubkeys")
+			diags.Warnf(file, path, "No host public key defined, connections to this server will fail")
+		}
+		for i, k := range server.HostPubKeys {
+			if len(k) == 0 {
+				continue
+			}
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err != nil {
+				file, path := serverPath(name, fmt.Sprintf("host_pubkeys[%d]", i))
+				diags.ToleratedErrorf(file, path, "Invalid host public key: %v", err)
+			}
+		}
+		file, path := serverPath(name, "request_policy")
+		checkRequestPolicy(diags, file, path, server.RequestPolicy)
+		if server.OnwardAgent && !config.Global.AllowAgentForwarding {
+			file, path := serverPath(name, "onward_agent_forwarding")
+			diags.Warnf(file, path, "Ignored, allow_agent_forwarding is not set")
+		}
+	}
+
+	groups := make(map[string]bool)
+	for _, g := range config.Groups {
+		groups[g] = true
+	}
+	for name, acl := range config.ACLs {
+		if strings.Contains(name, ",") {
+			diags.Errorf(filename, "acls."+name, "ACL names can't contain a comma")
+		}
+		for i, s := range acl.AllowedServers {
+			if _, ok := config.Servers[s]; !ok {
+				diags.Warnf(filename, fmt.Sprintf("acls.%s.allow_servers[%d]", name, i), "Server %q is not defined", s)
+			}
+		}
+		for i, g := range acl.AllowedGroups {
+			if !groups[g] {
+				diags.Warnf(filename, fmt.Sprintf("acls.%s.allow_groups[%d]", name, i), "Group %q is not declared in groups", g)
+			}
+		}
+		switch acl.SFTPRelay {
+		case "", sftpRelayReadWrite, sftpRelayReadOnly:
+		default:
+			diags.Errorf(filename, "acls."+name+".sftp_relay", "Invalid mode %q (expected %s or %s)", acl.SFTPRelay, sftpRelayReadOnly, sftpRelayReadWrite)
+		}
+		for i, p := range acl.SFTPRelayPaths {
+			if !strings.HasPrefix(p, "/") {
+				diags.Errorf(filename, fmt.Sprintf("acls.%s.sftp_relay_paths[%d]", name, i), "Path %q is not absolute", p)
+			}
+		}
+		if len(acl.SFTPRelayPaths) > 0 && len(acl.SFTPRelay) == 0 {
+			diags.Warnf(filename, "acls."+name+".sftp_relay_paths", "Ignored, sftp_relay is not set")
+		}
+		switch acl.SCPRelay {
+		case "", sftpRelayReadWrite, sftpRelayReadOnly:
+		default:
+			diags.Errorf(filename, "acls."+name+".scp_relay", "Invalid mode %q (expected %s or %s)", acl.SCPRelay, sftpRelayReadOnly, sftpRelayReadWrite)
+		}
+		for i, p := range acl.AllowForwards {
+			if err := checkForwardPattern(p); err != nil {
+				diags.Errorf(filename, fmt.Sprintf("acls.%s.allow_forwards[%d]", name, i), "Invalid pattern %q: %v", p, err)
+			}
+		}
+		for i, p := range acl.AllowRemoteForwards {
+			path := fmt.Sprintf("acls.%s.allow_remote_forwards[%d]", name, i)
+			if err := checkRemoteForwardPattern(p); err != nil {
+				diags.Errorf(filename, path, "Invalid pattern %q: %v", p, err)
+				continue
+			}
+			h, _, _ := net.SplitHostPort(p)
+			if ip := net.ParseIP(h); ip != nil && !ip.IsLoopback() && !ip.IsPrivate() {
+				diags.Warnf(filename, path, "%s is neither a loopback nor a private address", h)
+			}
+		}
+		checkRequestPolicy(diags, filename, "acls."+name+".request_policy", acl.RequestPolicy)
+		if acl.OnwardAgent && !config.Global.AllowAgentForwarding {
+			diags.Warnf(filename, "acls."+name+".onward_agent_forwarding", "Ignored, allow_agent_forwarding is not set")
+		}
+		if acl.SCPCapture && len(config.Global.CapturePath) == 0 {
+			diags.Errorf(filename, "acls."+name+".scp_capture", "No capture directory defined (capture_path)")
+		}
+	}
+
+	for name, user := range config.Users {
+		if len(user.ACL) == 0 {
+			diags.ToleratedErrorf(filename, "users."+name+".acl", "No ACL defined")
+		} else if _, ok := config.ACLs[user.ACL]; !ok {
+			diags.ToleratedErrorf(filename, "users."+name+".acl", "ACL %q is not defined", user.ACL)
+		}
+		for i, f := range user.AgentKeys {
+			if !strings.HasPrefix(f, "SHA256:") {
+				diags.ToleratedErrorf(filename, fmt.Sprintf("users.%s.agent_keys[%d]", name, i), "Invalid fingerprint %q (expected SHA256:...)", f)
+			}
+		}
+		if len(user.AgentKeys) > 0 && !config.Global.AllowAgentForwarding {
+			diags.Warnf(filename, "users."+name+".agent_keys", "Ignored, allow_agent_forwarding is not set")
+		}
+
+		if len(user.AuthorizedKeyStr) > 0 {
+			if _, _, options, _, err := ssh.ParseAuthorizedKey([]byte(user.AuthorizedKeyStr)); err != nil {
+				diags.ToleratedErrorf(filename, "users."+name+".authorized_key", "Invalid authorized key: %v", err)
+			} else if _, err := parseKeyOptions(options); err != nil {
+				diags.ToleratedErrorf(filename, "users."+name+".authorized_key", "Invalid authorized key options, the key is ignored: %v", err)
+			}
+			if len(user.AuthorizedKeysFile) > 0 {
+				diags.Warnf(filename, "users."+name+".authorized_keys_file", "Ignored because authorized_key is set")
+			}
+		} else if len(user.AuthorizedKeysFile) > 0 {
+			authKeysData, err := ioutil.ReadFile(user.AuthorizedKeysFile)
+			if err != nil {
+				diags.ToleratedErrorf(filename, "users."+name+".authorized_keys_file", "Unable to read authorized keys file: %v", err)
+			}
+			for len(authKeysData) > 0 {
+				var options []string
+				_, _, options, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
+				if err != nil {
+					diags.ToleratedErrorf(filename, "users."+name+".authorized_keys_file", "Error while processing authorized keys file %s: %v", user.AuthorizedKeysFile, err)
+					break
+				}
+				if _, err := parseKeyOptions(options); err != nil {
+					diags.ToleratedErrorf(user.AuthorizedKeysFile, name, "Invalid authorized key options, the key is ignored: %v", err)
+				}
+			}
+		} else if chain, err := config.AuthChain(name); err == nil {
+			usable := false
+			for _, n := range chain {
+				if _, ok := authenticators[n]; ok && n != "publickey" {
+					usable = true
+				}
+			}
+			if !usable {
+				diags.Warnf(filename, "users."+name, "User has no authorized keys and no other auth backend, login is impossible")
+			}
+		}
+	}
+}
+
+type checkConfigCommand struct {
+	Strict bool `long:"strict" description:"Fail on warnings too"`
+}
+
+func (c *checkConfigCommand) Execute(args []string) error {
+	_, diags := loadConfig(opts.Config)
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Path < diags[j].Path
+	})
+	for _, d := range diags {
+		fmt.Println(d)
+	}
+
+	errs, warnings := diags.Count()
+	fmt.Printf("%s: %d error(s), %d warning(s)\n", opts.Config, errs, warnings)
+	if errs > 0 || (c.Strict && warnings > 0) {
+		return errors.New("Configuration check failed")
+	}
+	return nil
+}
@@ -3,9 +3,12 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"sync/atomic"
 
+	"golang.org/x/crypto/ssh"
 	"gopkg.in/yaml.v2"
 )
 
@@ -18,43 +21,211 @@ type SSHConfig struct {
 }
 
 type SSHConfigGlobal struct {
-	GroupPath            string   `yaml:"group_path"`
-	MOTDPath             string   `yaml:"motd_path"`
-	LogPath              string   `yaml:"log_path"`
-	StoragePath          string   `yaml:"storage_path"`
-	BastionPrivateKeys   []string `yaml:"bastion_private_keys"`
-	AuthWithBastionKeys  bool     `yaml:"auth_with_bastion_keys"`
-	IgnoreHostPubKeys    bool     `yaml:"ignore_hosts_pubkeys"`
-	AllowAgentForwarding bool     `yaml:"allow_agent_forwarding"`
-	AuthType             string   `yaml:"auth_type"`
-	LDAP_Server          string   `yaml:"ldap_server"`
-	LDAP_Domain          string   `yaml:"ldap_domain"`
-	PassPassword         bool     `yaml:"pass_password"`
-	ListenPath           string   `yaml:"listen_path"`
-	NoIP6Bind            bool     `yaml:"disable_ipv6_bind"`
-	ConnectTimeout       string   `yaml:"connect_timeout"`
-	FluentbitServer      string   `yaml:"fluentbit_server"`
+	GroupPath            string            `yaml:"group_path"`
+	MOTDPath             string            `yaml:"motd_path"`
+	LogPath              string            `yaml:"log_path"`
+	StoragePath          string            `yaml:"storage_path"`
+	BastionPrivateKeys   []string          `yaml:"bastion_private_keys"`
+	AuthWithBastionKeys  bool              `yaml:"auth_with_bastion_keys"`
+	IgnoreHostPubKeys    bool              `yaml:"ignore_hosts_pubkeys"`
+	AllowAgentForwarding bool              `yaml:"allow_agent_forwarding"`
+	AuthType             string            `yaml:"auth_type"`
+	LDAP_Server          string            `yaml:"ldap_server"`
+	LDAP_Servers         []string          `yaml:"ldap_servers"`
+	LDAP_Domain          string            `yaml:"ldap_domain"`
+	LDAP_StartTLS        bool              `yaml:"ldap_starttls"`
+	LDAP_CAFile          string            `yaml:"ldap_ca_file"`
+	LDAP_ConnectTimeout  string            `yaml:"ldap_connect_timeout"`
+	LDAP_BindDN          string            `yaml:"ldap_bind_dn"`
+	LDAP_BindPassword    string            `yaml:"ldap_bind_password"`
+	LDAP_BaseDN          string            `yaml:"ldap_base_dn"`
+	LDAP_UserFilter      string            `yaml:"ldap_user_filter"`
+	LDAP_PoolSize        int               `yaml:"ldap_pool_size"`
+	LDAP_GroupACLs       map[string]string `yaml:"ldap_group_acls"`
+	LDAP_NestedGroups    bool              `yaml:"ldap_nested_groups"`
+	LDAP_GroupFilter     string            `yaml:"ldap_group_filter"`
+	LDAP_GroupBaseDN     string            `yaml:"ldap_group_base_dn"`
+	PasswordFile         string            `yaml:"password_file"`
+	TrustedUserCAKeys    []string          `yaml:"trusted_user_ca_keys"`
+	RevokedUserCertsFile string            `yaml:"revoked_user_certs_file"`
+	TrustedHostCAKeys    []string          `yaml:"trusted_host_ca_keys"`
+	RevokedHostCertsFile string            `yaml:"revoked_host_certs_file"`
+	CertPrincipalUsers   map[string]string `yaml:"cert_principal_users"`
+	CertPrincipalACLs    map[string]string `yaml:"cert_principal_acls"`
+	PassPassword         bool              `yaml:"pass_password"`
+	ListenPath           string            `yaml:"listen_path"`
+	NoIP6Bind            bool              `yaml:"disable_ipv6_bind"`
+	ConnectTimeout       string            `yaml:"connect_timeout"`
+	FluentbitServer      string            `yaml:"fluentbit_server"`
+	AdminSocket          string            `yaml:"admin_socket"`
+	TOTPSecretsFile      string            `yaml:"totp_secrets_file"`
+	TOTPIssuer           string            `yaml:"totp_issuer"`
+	BanMaxFailures       int               `yaml:"ban_max_failures"`
+	BanTime              string            `yaml:"ban_time"`
+	BanIgnoreIPs         []string          `yaml:"ban_ignore_ips"`
+	CapturePath          string            `yaml:"capture_path"`
+	HostKeyTOFU          bool              `yaml:"host_key_tofu"`
+	AlertCommand         string            `yaml:"alert_command"`
+
+	GroupTrustedHostCAKeys map[string][]string `yaml:"group_trusted_host_ca_keys"`
 }
 
 type SSHConfigACL struct {
-	AllowedServers []string `yaml:"allow_servers"`
-	AllowedGroups  []string `yaml:"allow_groups"`
+	AllowedServers      []string `yaml:"allow_servers"`
+	AllowedGroups       []string `yaml:"allow_groups"`
+	Auth                []string `yaml:"auth"`
+	RequireTOTP         bool     `yaml:"require_totp"`
+	AllowExec           bool     `yaml:"allow_exec"`
+	SFTPRelay           string   `yaml:"sftp_relay"`
+	SFTPRelayPaths      []string `yaml:"sftp_relay_paths"`
+	SCPRelay            string   `yaml:"scp_relay"`
+	SCPCapture          bool     `yaml:"scp_capture"`
+	AllowForwards       []string `yaml:"allow_forwards"`
+	AllowRemoteForwards []string `yaml:"allow_remote_forwards"`
+	AllowX11            bool     `yaml:"allow_x11"`
+	OnwardAgent         bool     `yaml:"onward_agent_forwarding"`
+
+	RequestPolicy *SSHConfigRequestPolicy `yaml:"request_policy"`
+
+	// Modes, paths and servers of the merged ACLs relaying SFTP, set by
+	// ResolveACL.
+	SFTPGrants []sftpGrant `yaml:"-"`
 }
 
 type SSHConfigUser struct {
-	ACL                string `yaml:"acl"`
-	AuthorizedKeyStr   string `yaml:"authorized_key"`
-	AuthorizedKeysFile string `yaml:"authorized_keys_file"`
+	ACL                string   `yaml:"acl"`
+	AuthorizedKeyStr   string   `yaml:"authorized_key"`
+	AuthorizedKeysFile string   `yaml:"authorized_keys_file"`
+	Auth               []string `yaml:"auth"`
+	AgentKeys          []string `yaml:"agent_keys"`
 }
 
 type SSHConfigServer struct {
 	HostPubKeys []string `yaml:"host_pubkeys"`
 	ConnectPath string   `yaml:"connect_path"`
 	LoginUser   string   `yaml:"login_user"`
+	FullName    string   `yaml:"full_name"`
+	AllowX11    bool     `yaml:"allow_x11"`
+	OnwardAgent bool     `yaml:"onward_agent_forwarding"`
 	Group       string   ""
+
+	ConnectPaths          []string `yaml:"connect_paths"`
+	ConnectOrder          string   `yaml:"connect_order"`
+	ConnectAttemptTimeout string   `yaml:"connect_attempt_timeout"`
+	HappyEyeballs         bool     `yaml:"happy_eyeballs"`
+
+	RequestPolicy *SSHConfigRequestPolicy `yaml:"request_policy"`
 }
 
-func fetchConfig(filename string) (*SSHConfig, error) {
+// UserACLs returns the names of the ACLs of an authenticated user: the acl of
+// the user in the configuration, plus the ones granted at login time from its
+// LDAP groups.
+func (config *SSHConfig) UserACLs(user string, perms *ssh.Permissions) []string {
+	names := []string{}
+	if u, ok := config.Users[user]; ok && len(u.ACL) > 0 {
+		names = append(names, u.ACL)
+	}
+	if perms != nil && len(perms.Extensions["acls"]) > 0 {
+		names = appendUnique(names, strings.Split(perms.Extensions["acls"], ",")...)
+	}
+	return names
+}
+
+// ResolveACL merges the named ACLs into a single one: lists are joined and
+// flags are set if any of the ACLs sets them, the most permissive sftp_relay
+// and scp_relay modes and request_policy win. The sftp_relay_paths are kept
+// with the mode and the servers of their ACL in SFTPGrants. Unknown names are
+// ignored, false is returned if none of them exists.
+func (config *SSHConfig) ResolveACL(names []string) (SSHConfigACL, bool) {
+	var acl SSHConfigACL
+	found := false
+	for _, name := range names {
+		a, ok := config.ACLs[name]
+		if !ok {
+			continue
+		}
+		if !found {
+			acl.RequestPolicy = a.RequestPolicy
+		} else {
+			acl.RequestPolicy = mergeRequestPolicies(acl.RequestPolicy, a.RequestPolicy)
+		}
+		found = true
+		acl.AllowedServers = appendUnique(acl.AllowedServers, a.AllowedServers...)
+		acl.AllowedGroups = appendUnique(acl.AllowedGroups, a.AllowedGroups...)
+		acl.AllowForwards = appendUnique(acl.AllowForwards, a.AllowForwards...)
+		acl.AllowRemoteForwards = appendUnique(acl.AllowRemoteForwards, a.AllowRemoteForwards...)
+		acl.RequireTOTP = acl.RequireTOTP || a.RequireTOTP
+		acl.AllowExec = acl.AllowExec || a.AllowExec
+		acl.AllowX11 = acl.AllowX11 || a.AllowX11
+		acl.OnwardAgent = acl.OnwardAgent || a.OnwardAgent
+		if a.SFTPRelay == sftpRelayReadWrite || len(acl.SFTPRelay) == 0 {
+			acl.SFTPRelay = a.SFTPRelay
+		}
+		if len(a.SFTPRelay) > 0 {
+			// An ACL relaying SFTP without paths allows the whole target.
+			paths := a.SFTPRelayPaths
+			if len(paths) == 0 {
+				paths = []string{"/"}
+			}
+			acl.SFTPRelayPaths = appendUnique(acl.SFTPRelayPaths, paths...)
+			acl.SFTPGrants = append(acl.SFTPGrants, sftpGrant{Mode: a.SFTPRelay, Paths: paths, Servers: a.AllowedServers})
+		}
+		if a.SCPRelay == sftpRelayReadWrite || len(acl.SCPRelay) == 0 {
+			acl.SCPRelay = a.SCPRelay
+		}
+		acl.SCPCapture = acl.SCPCapture || a.SCPCapture
+	}
+	return acl, found
+}
+
+// ResolveServerACL merges the named ACLs which allow server, so the rights
+// of an ACL only apply to its own servers. false is returned if none of them
+// allows server.
+func (config *SSHConfig) ResolveServerACL(names []string, server string) (SSHConfigACL, bool) {
+	allowing := []string{}
+	for _, name := range names {
+		if a, ok := config.ACLs[name]; ok && contains(a.AllowedServers, server) {
+			allowing = append(allowing, name)
+		}
+	}
+	return config.ResolveACL(allowing)
+}
+
+func contains(list []string, value string) bool {
+	for _, l := range list {
+		if l == value {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		if !contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// activeConfig holds the *SSHConfig currently in use by the daemon. It is
+// swapped as a whole on reload, so a session holding a snapshot is never
+// affected by a later reload.
+var activeConfig atomic.Value
+
+func currentConfig() *SSHConfig {
+	c, _ := activeConfig.Load().(*SSHConfig)
+	return c
+}
+
+func setConfig(c *SSHConfig) {
+	activeConfig.Store(c)
+}
+
+// readConfigFile only parses the main YAML file, without loading keys or
+// group files.
+func readConfigFile(filename string) (*SSHConfig, error) {
 	configData, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open config file: %s", err)
@@ -66,56 +237,153 @@ func fetchConfig(filename string) (*SSHConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Unable to parse YAML config file: %s", err)
 	}
+	return config, nil
+}
+
+// fetchConfig loads the configuration the way the daemon uses it. Warnings
+// and tolerated errors are logged, and the first other error found makes the
+// whole configuration invalid.
+func fetchConfig(filename string) (*SSHConfig, error) {
+	config, diags := loadConfig(filename)
+	diags = diags.Daemon()
+	for _, d := range diags {
+		if d.Severity == SeverityWarning {
+			log.Printf("Configuration warning: %s", d)
+		}
+	}
+	if err := diags.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadConfig reads the configuration file and every group file, loads the
+// keys and checks the result. It doesn't stop at the first problem, every
+// error and warning is returned in the diagnostics.
+func loadConfig(filename string) (*SSHConfig, ConfigDiagnostics) {
+	var diags ConfigDiagnostics
+
+	config, err := readConfigFile(filename)
+	if err != nil {
+		diags.Errorf(filename, "", "%v", err)
+		return nil, diags
+	}
+	diags.checkUnknownFields(filename, &SSHConfig{})
+
+	if config.Servers == nil {
+		config.Servers = make(map[string]SSHConfigServer)
+	}
 
 	for i, v := range config.Global.BastionPrivateKeys {
 		config.Global.BastionPrivateKeys[i], err = loadKey(v)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to load key %s: %v", v, err)
+			diags.Errorf(filename, fmt.Sprintf("global.bastion_private_keys[%d]", i), "%v", err)
+		}
+	}
+
+	for i, v := range config.Global.TrustedUserCAKeys {
+		config.Global.TrustedUserCAKeys[i], err = loadKey(v)
+		if err != nil {
+			diags.Errorf(filename, fmt.Sprintf("global.trusted_user_ca_keys[%d]", i), "%v", err)
+		}
+	}
+
+	for i, v := range config.Global.TrustedHostCAKeys {
+		config.Global.TrustedHostCAKeys[i], err = loadKey(v)
+		if err != nil {
+			diags.Errorf(filename, fmt.Sprintf("global.trusted_host_ca_keys[%d]", i), "%v", err)
+		}
+	}
+	for group, keys := range config.Global.GroupTrustedHostCAKeys {
+		for i, v := range keys {
+			keys[i], err = loadKey(v)
+			if err != nil {
+				diags.Errorf(filename, fmt.Sprintf("global.group_trusted_host_ca_keys.%s[%d]", group, i), "%v", err)
+			}
+		}
+	}
+
+	if len(config.Global.LDAP_BindPassword) > 0 {
+		config.Global.LDAP_BindPassword, err = loadKey(config.Global.LDAP_BindPassword)
+		if err != nil {
+			diags.Errorf(filename, "global.ldap_bind_password", "%v", err)
+		}
+		config.Global.LDAP_BindPassword = strings.TrimRight(config.Global.LDAP_BindPassword, "\r\n")
+	}
+
+	for k_target, target := range config.Servers {
+		for i, v := range target.HostPubKeys {
+			target.HostPubKeys[i], err = loadKey(v)
+			if err != nil {
+				diags.ToleratedErrorf(filename, fmt.Sprintf("servers.%s.host_pubkeys[%d]", k_target, i), "%v", err)
+			}
 		}
 	}
 
+	// Servers declared in the main file override the ones from groups.
+	definedIn := make(map[string]string)
+	for k_target := range config.Servers {
+		definedIn[k_target] = filename
+	}
+
+	groupMembers := make(map[string][]string)
 	for _, group := range config.Groups {
-		groupData, err := ioutil.ReadFile(config.Global.GroupPath + "/" + group + ".yaml")
+		groupFile := config.Global.GroupPath + "/" + group + ".yaml"
+		groupData, err := ioutil.ReadFile(groupFile)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to open group file: %s", err)
+			diags.Errorf(filename, "groups", "Failed to open group file: %s", err)
+			continue
 		}
 		var t map[string]SSHConfigServer
 		err = yaml.Unmarshal(groupData, &t)
 		if err != nil {
-			return nil, fmt.Errorf("Unable to parse YAML group file: %s", err)
+			diags.Errorf(groupFile, "", "Unable to parse YAML group file: %s", err)
+			continue
 		}
+		diags.checkUnknownFields(groupFile, &map[string]SSHConfigServer{})
+
 		for k_target, target := range t {
-			target.Group = group
-			config.Servers[k_target] = target
+			groupMembers[group] = append(groupMembers[group], k_target)
 
-			for k_acl, acl := range config.ACLs {
-				acl_dup := acl
-				for _, a := range acl.AllowedGroups {
-					if a == group {
-						acl_dup.AllowedServers = append(acl.AllowedServers, k_target)
-						break
-					}
+			if previous, ok := definedIn[k_target]; ok {
+				if previous == filename {
+					diags.Warnf(groupFile, k_target, "Server is also declared in %s, the group declaration is ignored", filename)
+				} else {
+					diags.ToleratedErrorf(groupFile, k_target, "Duplicate server name, already declared in %s", previous)
 				}
-				config.ACLs[k_acl] = acl_dup
+				continue
 			}
+			definedIn[k_target] = groupFile
 
+			target.Group = group
 			for i, v := range target.HostPubKeys {
-				config.Servers[k_target].HostPubKeys[i], err = loadKey(v)
+				target.HostPubKeys[i], err = loadKey(v)
 				if err != nil {
-					return nil, fmt.Errorf("Unable to load key %s: %v", v, err)
+					diags.ToleratedErrorf(groupFile, fmt.Sprintf("%s.host_pubkeys[%d]", k_target, i), "%v", err)
 				}
 			}
-
+			config.Servers[k_target] = target
 		}
+	}
+
+	checkConfig(config, filename, definedIn, &diags)
 
+	for k_acl, acl := range config.ACLs {
+		for _, a := range acl.AllowedGroups {
+			acl.AllowedServers = append(acl.AllowedServers, groupMembers[a]...)
+		}
+		config.ACLs[k_acl] = acl
 	}
 
-	resp, err := http.Get(config.Global.FluentbitServer)
-	if err != nil {
-		return nil, fmt.Errorf("Unable to join %s: %v", config.Global.FluentbitServer, err)
+	if len(config.Global.FluentbitServer) > 0 {
+		resp, err := http.Get(config.Global.FluentbitServer)
+		if err != nil {
+			diags.Errorf(filename, "global.fluentbit_server", "Unable to join %s: %v", config.Global.FluentbitServer, err)
+		} else {
+			resp.Body.Close()
+		}
 	}
-	defer resp.Body.Close()
-	return config, nil
+	return config, diags
 }
 
 func loadKey(target string) (string, error) {
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+// Two ACLs covering different servers: the rights of each one must only
+// apply to its own servers.
+func TestResolveServerACLKeepsRightsWithTheirServers(t *testing.T) {
+	config := &SSHConfig{ACLs: map[string]SSHConfigACL{
+		"ops": {AllowedServers: []string{"db01"}, AllowExec: true, SCPRelay: sftpRelayReadWrite, AllowX11: true, OnwardAgent: true},
+		"dev": {AllowedServers: []string{"web01"}, SFTPRelay: sftpRelayReadOnly},
+	}}
+	names := []string{"ops", "dev"}
+
+	acl, ok := config.ResolveServerACL(names, "web01")
+	if !ok {
+		t.Fatal("No ACL allows web01")
+	}
+	if acl.AllowExec || len(acl.SCPRelay) > 0 || acl.AllowX11 || acl.OnwardAgent {
+		t.Errorf("Rights of ops applied on web01: %+v", acl)
+	}
+	if acl.SFTPRelay != sftpRelayReadOnly {
+		t.Errorf("sftp_relay on web01 = %q, want %q", acl.SFTPRelay, sftpRelayReadOnly)
+	}
+
+	acl, ok = config.ResolveServerACL(names, "db01")
+	if !ok {
+		t.Fatal("No ACL allows db01")
+	}
+	if !acl.AllowExec || acl.SCPRelay != sftpRelayReadWrite || len(acl.SFTPRelay) > 0 {
+		t.Errorf("Rights on db01 = %+v, want the ones of ops only", acl)
+	}
+
+	if _, ok := config.ResolveServerACL(names, "mail01"); ok {
+		t.Error("mail01 is allowed by none of the ACLs")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+// A server can be reached through several connect_paths, tried in order or
+// in a random order (connect_order) until one of them answers. An attempt
+// fails over to the next path when the connection or the beginning of the
+// handshake fails, up to the reception of the host key of the target, and
+// is limited to connect_attempt_timeout. With happy_eyeballs, the next path
+// is tried after a short delay without waiting for the previous attempt to
+// fail, the first connection established wins.
+
+const (
+	connectOrdered = "ordered"
+	connectRandom  = "random"
+)
+
+// Delay between two attempts with happy_eyeballs, after RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// ConnectAddresses returns the addresses of the server, in the order of the
+// configuration.
+func (s SSHConfigServer) ConnectAddresses() []string {
+	if len(s.ConnectPaths) > 0 {
+		return s.ConnectPaths
+	}
+	if len(s.ConnectPath) > 0 {
+		return []string{s.ConnectPath}
+	}
+	return nil
+}
+
+// connectAttempts returns the addresses of the server in the order of the
+// attempts.
+func (s SSHConfigServer) connectAttempts() []string {
+	addresses := append([]string{}, s.ConnectAddresses()...)
+	if s.ConnectOrder == connectRandom {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(addresses), func(i, j int) { addresses[i], addresses[j] = addresses[j], addresses[i] })
+	}
+	return addresses
+}
+
+// attemptTimeout returns the connect_attempt_timeout of the server, or
+// timeout if it is not set.
+func (s SSHConfigServer) attemptTimeout(timeout time.Duration) time.Duration {
+	if len(s.ConnectAttemptTimeout) > 0 {
+		if t, err := time.ParseDuration(s.ConnectAttemptTimeout); err == nil {
+			return t
+		}
+	}
+	return timeout
+}
+
+// dialConnectPaths connects to one of addresses, and returns the connection
+// with the address used. failed is called for each failed attempt.
+func dialConnectPaths(addresses []string, happyEyeballs bool, timeout time.Duration, failed func(address string, err error)) (net.Conn, string, error) {
+	if len(addresses) == 0 {
+		return nil, "", errors.New("No connect path defined")
+	}
+	if len(addresses) == 1 {
+		conn, err := net.DialTimeout("tcp", addresses[0], timeout)
+		return conn, addresses[0], err
+	}
+	if happyEyeballs {
+		return dialHappyEyeballs(addresses, timeout, failed)
+	}
+
+	errs := []string{}
+	for _, address := range addresses {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil {
+			return conn, address, nil
+		}
+		failed(address, err)
+		errs = append(errs, err.Error())
+	}
+	return nil, "", fmt.Errorf("All connect paths failed: %s", strings.Join(errs, "; "))
+}
+
+// dialHappyEyeballs starts an attempt on the next address every
+// happyEyeballsDelay, or as soon as an attempt fails, and returns the first
+// connection established. The other attempts are cancelled.
+func dialHappyEyeballs(addresses []string, timeout time.Duration, failed func(address string, err error)) (net.Conn, string, error) {
+	type attempt struct {
+		conn    net.Conn
+		address string
+		err     error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan attempt, len(addresses))
+	dialer := &net.Dialer{Timeout: timeout}
+
+	next, running := 0, 0
+	start := func() {
+		address := addresses[next]
+		next++
+		running++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", address)
+			results <- attempt{conn, address, err}
+		}()
+	}
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(happyEyeballsDelay)
+	}
+
+	errs := []string{}
+	start()
+	for running > 0 {
+		select {
+		case a := <-results:
+			running--
+			if a.err == nil {
+				// Close the connections established in the meantime.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.err == nil {
+							late.conn.Close()
+						}
+					}
+				}(running)
+				return a.conn, a.address, nil
+			}
+			failed(a.address, a.err)
+			errs = append(errs, a.err.Error())
+			if next < len(addresses) {
+				start()
+				restart()
+			}
+		case <-timer.C:
+			if next < len(addresses) {
+				start()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, "", fmt.Errorf("All connect paths failed: %s", strings.Join(errs, "; "))
+}
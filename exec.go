@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// parseExecPayload splits the command of a session into a target and a
+// command to run on it: "target", "target command" or "target -- command".
+// When the target is given in the login, the whole payload is the command.
+func parseExecPayload(loginTarget string, payload string) (string, string) {
+	payload = strings.TrimSpace(payload)
+	if len(loginTarget) > 0 {
+		return loginTarget, payload
+	}
+
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return "", ""
+	}
+	command := strings.TrimSpace(strings.TrimPrefix(payload, fields[0]))
+	if command == "--" {
+		command = ""
+	} else if strings.HasPrefix(command, "-- ") {
+		command = strings.TrimSpace(command[3:])
+	}
+	return fields[0], command
+}
+
+// ExecRelay runs command on the target over a new session of client. The
+// requests received before the exec one (pty-req, env) are sent first, then
+// the input, output and exit status of the command are relayed. The command,
+// its exit status and duration are recorded in the session logs. With
+// agentForwarding, the agent of the client is forwarded to the command. With a
+// transfer, the input and output are followed as an scp session.
+func ExecRelay(reqs <-chan *ssh.Request, execReq *ssh.Request, channel *LogChannel, client *ssh.Client, remote_name string, command string, agentForwarding bool, transfer *scpTransfer) {
+	defer channel.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "Remote session setup failed: %v\r\n", err)
+		return
+	}
+	defer session.Close()
+
+	if agentForwarding {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			channel.LogEvent("Agent forwarding refused by the target", "Target", remote_name)
+		}
+	}
+
+	forward := func(req *ssh.Request) {
+		ok, err := session.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok && err == nil, nil)
+		}
+	}
+pending:
+	for {
+		select {
+		case req := <-reqs:
+			forward(req)
+		default:
+			break pending
+		}
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		fmt.Fprintf(channel.Stderr(), "Remote session setup failed: %v\r\n", err)
+		return
+	}
+	var stdout io.Reader
+	if transfer != nil {
+		stdout, err = session.StdoutPipe()
+		if err != nil {
+			fmt.Fprintf(channel.Stderr(), "Remote session setup failed: %v\r\n", err)
+			return
+		}
+	} else {
+		session.Stdout = channel
+	}
+	session.Stderr = channel.Stderr()
+
+	channel.LogEvent("Executing command", "Target", remote_name, "Command", command)
+	start := time.Now()
+	if err := session.Start(command); err != nil {
+		if execReq.WantReply {
+			execReq.Reply(false, nil)
+		}
+		channel.LogEvent("Command failed to start", "Error", err.Error())
+		return
+	}
+	if execReq.WantReply {
+		execReq.Reply(true, nil)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case req := <-reqs:
+				forward(req)
+			case <-done:
+				return
+			}
+		}
+	}()
+	relayed := make(chan struct{})
+	if transfer != nil {
+		go func() {
+			defer close(relayed)
+			// The files are not written to the session logs, they are
+			// recorded by the transfer.
+			transfer.Relay(channel.ActualChannel, stdin, stdout)
+			stdin.Close()
+		}()
+	} else {
+		close(relayed)
+		go func() {
+			io.Copy(stdin, channel)
+			stdin.Close()
+		}()
+	}
+
+	status, signal := 0, ""
+	if err := session.Wait(); err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			status, signal = exitErr.ExitStatus(), exitErr.Signal()
+		} else {
+			status = 255
+		}
+	}
+	// The end of the output may not be relayed yet.
+	<-relayed
+	duration := time.Since(start)
+
+	if len(signal) > 0 {
+		channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}{signal, false, "", ""}))
+		channel.LogEvent("Command terminated", "Signal", signal, "Duration", duration.String())
+	} else {
+		channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		channel.LogEvent("Command exited", "Exit status", strconv.Itoa(status), "Duration", duration.String())
+	}
+	channel.ActualChannel.CloseWrite()
+}
@@ -7,7 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
-
+	"strings"
 	"sync"
 	"time"
 
@@ -39,32 +39,45 @@ func SecureConvertPayloadToString(Payload []byte) (string, error) {
 
 }
 
-func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn, newChannel ssh.NewChannel, chans <-chan ssh.NewChannel) {
+// SessionForward serves a session channel of conn: it runs the target
+// selection and relays the session, recorded in its own log files.
+func (s *SSHServer) SessionForward(conn *BastionConn, newChannel ssh.NewChannel) {
+	config := conn.Config
+	sshConn := conn
+
 	rawsesschan, sessReqs, err := newChannel.Accept()
 	if err != nil {
-		sshConn.Close()
 		return
 	}
-	defer sshConn.Close()
 
-	sesschan := NewLogChannel(startTime, rawsesschan, sshConn.User(), sshConn.RemoteAddr().String(), sshConn.Permissions.Extensions["authType"])
+	id := conn.nextChannelID()
+	startTime := conn.StartTime
+	if id > 0 {
+		startTime = time.Now()
+	}
+	sesschan := NewLogChannel(config, startTime, rawsesschan, sshConn.User(), sshConn.RemoteAddr().String(), sshConn.Permissions.Extensions["authType"])
+	sesschan.ChannelID = id
 
-	go func() {
-		for newChannel = range chans {
-			if newChannel == nil {
-				return
-			}
-			newChannel.Reject(ssh.Prohibited, "remote server denied channel request")
-			continue
-		}
-	}()
+	// Restrictions set by the options of the authorized key.
+	restricted := func(name string) bool {
+		return len(sshConn.Permissions.Extensions[name]) > 0
+	}
 
 	var agentForwarding bool = false
-	var startInteractiveSession bool = false
-
+	var execTarget, execCommand string
+	var execReq *ssh.Request
+	var scp *scpTransfer
+	var scpErr error
+
+	// started is closed when the client asks for an interactive session,
+	// reqsDone when the channel requests are not read anymore.
+	started := make(chan struct{})
+	reqsDone := make(chan struct{})
 	maskedReqs := make(chan *ssh.Request, 5)
 
 	go func() {
+		defer close(reqsDone)
+		startInteractiveSession := false
 		for req := range sessReqs {
 
 			payload_str, err := SecureConvertPayloadToString(req.Payload)
@@ -74,37 +87,78 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 				return
 			}
 			sesschan.LogRequest(req)
-			if (req.Type == "auth-agent-req@openssh.com") && config.Global.AllowAgentForwarding {
+			if (req.Type == "auth-agent-req@openssh.com") && config.Global.AllowAgentForwarding && !restricted("noAgentForwarding") {
 				agentForwarding = true
 				if req.WantReply {
 					req.Reply(true, []byte{})
 				}
 				continue
-			} else if (req.Type == "pty-req") && (req.WantReply) {
-				if startInteractiveSession {
-					req.Reply(true, []byte{})
-					req.WantReply = false
-				} else {
-					startInteractiveSession = true
+			} else if (req.Type == "auth-agent-req@openssh.com") || (req.Type == "pty-req" && restricted("noPty")) || (req.Type == "x11-req" && restricted("noX11Forwarding")) {
+				if req.WantReply {
+					req.Reply(false, []byte{})
 				}
+				continue
+			} else if (req.Type == "pty-req") && (req.WantReply) {
+				// Answered right away, some clients wait for the reply before
+				// asking for the shell. The request is replayed to the target
+				// once it is connected.
+				req.Reply(true, []byte{})
+				req.WantReply = false
 			} else if (req.Type == "shell") && (req.WantReply) {
 				if startInteractiveSession {
 					req.Reply(true, []byte{})
 					req.WantReply = false
 				} else {
 					startInteractiveSession = true
+					close(started)
 				}
 
+			} else if (req.Type == "exec") && !startInteractiveSession && len(strings.TrimSpace(payload_str)) > 0 {
+				if scp, scpErr = parseSCPCommand(payload_str); scp != nil || scpErr != nil {
+					// scp runs its command on the target given in the login.
+					execTarget, execCommand = conn.Target, strings.TrimSpace(payload_str)
+				} else {
+					execTarget, execCommand = parseExecPayload(conn.Target, payload_str)
+				}
+				startInteractiveSession = true
+				if len(execCommand) > 0 {
+					// Replied by ExecRelay once the command is started.
+					execReq = req
+					close(started)
+					continue
+				}
+				// "ssh -t bastion target": the command names the target, the
+				// session is started as a shell on it.
+				req.Type = "shell"
+				req.Payload = nil
+				close(started)
 			} else if (req.Type == "exec") && (req.WantReply) {
-				req.Reply(true, []byte{})
-				req.WantReply = false
+				req.Reply(false, []byte{})
+				continue
 			} else if (req.Type == "subsystem") && (req.WantReply) {
 				if startInteractiveSession {
 					req.Reply(true, []byte{})
 					req.WantReply = false
 				} else {
-
+					// The policy of the target is checked by the relay.
+					acl, _ := config.ResolveACL(config.UserACLs(sshConn.User(), sshConn.Permissions))
+					if _, err := acl.RequestPolicy.Check(req.Type, req.Payload); err != nil {
+						sesschan.LogEvent("Request denied", "Type", req.Type, "Reason", err.Error())
+						WriteAuthLog("Refused %s request of %s from %s: %v.", req.Type, sshConn.User(), sshConn.RemoteAddr(), err)
+						req.Reply(false, nil)
+						continue
+					}
 					if payload_str == "sftp" {
+						if conn.TOTPPending() {
+							log.Printf("Refused sftp session of %s: verification code required.", sshConn.User())
+							sesschan.Close()
+							return
+						}
+						if len(conn.Target) > 0 {
+							SFTPRelay(conn, req, sesschan)
+							sesschan.Close()
+							return
+						}
 						fs, err := createHandler(config.Global.StoragePath, sesschan)
 						if err != nil {
 							log.Printf("Unable to get user home: %v\n", err)
@@ -127,6 +181,11 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 						sesschan.Close()
 						return
 					}
+					err := fmt.Errorf("subsystem %s is not available", payload_str)
+					sesschan.LogEvent("Request denied", "Type", req.Type, "Reason", err.Error())
+					WriteAuthLog("Refused %s request of %s from %s: %v.", req.Type, sshConn.User(), sshConn.RemoteAddr(), err)
+					req.Reply(false, nil)
+					continue
 				}
 				return
 			}
@@ -134,47 +193,137 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 		}
 	}()
 
-	for {
-		if startInteractiveSession {
-			break
-		}
+	select {
+	case <-started:
+	case <-reqsDone:
+		rawsesschan.Close()
+		return
 	}
 
-	fmt.Fprintf(sesschan, "%s\r\n", GetMOTD())
+	// In exec mode, the messages of the bastion go to stderr to keep the
+	// output of the command clean.
+	execMode := len(execCommand) > 0
+	var out io.Writer = sesschan
+	if execMode {
+		out = sesschan.Stderr()
+	}
+
+	if execMode && conn.TOTPPending() {
+		fmt.Fprintf(out, "Verification code required, open an interactive session first.\r\n")
+		sesschan.Close()
+		return
+	}
+	if err := conn.VerifyTOTP(sesschan); err != nil {
+		fmt.Fprintf(sesschan, "Verification failed.\r\n")
+		sesschan.Close()
+		sshConn.Close()
+		return
+	}
+
+	if scpErr != nil {
+		fmt.Fprintf(out, "Invalid scp command: %v.\r\n", scpErr)
+		sesschan.Close()
+		return
+	}
+
+	if !execMode {
+		fmt.Fprintf(sesschan, "%s\r\n", GetMOTD(config))
+	}
 
 	var remote SSHConfigServer
 	var remote_name string
 	var remote_action string
-	if user, ok := config.Users[sshConn.User()]; !ok {
-		fmt.Fprintf(sesschan, "User has no permitted remote hosts.\r\n")
+	var allowX11, onwardAgent bool
+	var policies []*SSHConfigRequestPolicy
+	if acl_names := config.UserACLs(sshConn.User(), sshConn.Permissions); len(acl_names) == 0 {
+		fmt.Fprintf(out, "User has no permitted remote hosts.\r\n")
 		sesschan.Close()
 		return
 	} else {
-		if acl, ok := config.ACLs[user.ACL]; !ok {
-			fmt.Fprintf(sesschan, "Error processing server selection (Invalid ACL).\r\n")
+		if acl, ok := config.ResolveACL(acl_names); !ok {
+			fmt.Fprintf(out, "Error processing server selection (Invalid ACL).\r\n")
 			log.Printf("Invalid ACL detected for user %s.", sshConn.User())
 			sesschan.Close()
 			return
 		} else {
-			cmd, svr, err := InteractiveSelection(sesschan, "Please enter the target name (or '?' for help) ", acl.AllowedServers)
-			if err != nil {
-				fmt.Fprintf(sesschan, "Error processing server selection.\r\n")
-				sesschan.Close()
-				return
+			cmd, svr := "session", strings.TrimSpace(sshConn.Permissions.Extensions["forceCommand"])
+			if len(svr) > 0 {
+				if !contains(acl.AllowedServers, svr) {
+					fmt.Fprintf(out, "Forced target %s is not permitted.\r\n", svr)
+					WriteAuthLog("Forced target %s of %s from %s is not permitted.", svr, sshConn.User(), sshConn.RemoteAddr())
+					sesschan.Close()
+					return
+				}
+			} else {
+				requested := execTarget
+				if len(requested) == 0 {
+					requested = conn.Target
+				}
+				if len(requested) > 0 && execMode {
+					if svr = exactTarget(config, acl.AllowedServers, requested); len(svr) == 0 {
+						fmt.Fprintf(out, "No permitted target is named %s.\r\n", requested)
+					}
+				} else if len(requested) > 0 {
+					var matches []string
+					svr, matches = resolveTarget(config, acl.AllowedServers, requested)
+					if len(svr) == 0 && len(matches) == 0 {
+						fmt.Fprintf(out, "No permitted target matches %s.\r\n", requested)
+					} else if len(svr) == 0 {
+						fmt.Fprintf(out, "Several targets match %s.\r\n", requested)
+					}
+				}
+				if scp != nil && len(requested) == 0 {
+					fmt.Fprintf(out, "The target of scp must be given in the login (user+target).\r\n")
+				}
+				if execMode && len(svr) == 0 {
+					sesschan.Close()
+					return
+				} else if len(svr) == 0 {
+					cmd, svr, err = InteractiveSelection(sesschan, "Please enter the target name (or '?' for help) ", acl.AllowedServers)
+					if err != nil {
+						fmt.Fprintf(sesschan, "Error processing server selection.\r\n")
+						sesschan.Close()
+						return
+					}
+				}
+			}
+			// The rights of an ACL only apply to the servers it allows.
+			acl, _ = config.ResolveServerACL(acl_names, svr)
+			if scp != nil {
+				if len(acl.SCPRelay) == 0 || (scp.Upload && acl.SCPRelay != sftpRelayReadWrite) {
+					fmt.Fprintf(out, "File %s with scp is not permitted.\r\n", scp.Direction())
+					WriteAuthLog("Refused scp %s on %s by %s from %s.", scp.Direction(), svr, sshConn.User(), sshConn.RemoteAddr())
+					sesschan.Close()
+					return
+				}
+				if acl.SCPCapture {
+					scp.capture = config.Global.CapturePath
+				}
+				cmd = "scp"
+			} else if execMode {
+				if !acl.AllowExec {
+					fmt.Fprintf(out, "Command execution is not permitted.\r\n")
+					WriteAuthLog("Refused command execution on %s by %s from %s.", svr, sshConn.User(), sshConn.RemoteAddr())
+					sesschan.Close()
+					return
+				}
+				cmd = "exec"
 			}
-
 			if server, ok := config.Servers[svr]; !ok {
-				fmt.Fprintf(sesschan, "Incorrectly Configured Server Selected.\r\n")
+				fmt.Fprintf(out, "Incorrectly Configured Server Selected.\r\n")
 				sesschan.Close()
 				return
-			} else if cmd != "session" {
-				fmt.Fprintf(sesschan, "Incorrectly Action Selected.\r\n")
+			} else if cmd != "session" && cmd != "exec" && cmd != "scp" {
+				fmt.Fprintf(out, "Incorrectly Action Selected.\r\n")
 				sesschan.Close()
 				return
 			} else {
 				remote_name = svr
 				remote = server
 				remote_action = cmd
+				allowX11 = acl.AllowX11 || server.AllowX11
+				onwardAgent = agentForwarding && (acl.OnwardAgent || server.OnwardAgent)
+				policies = []*SSHConfigRequestPolicy{acl.RequestPolicy, server.RequestPolicy}
 			}
 		}
 	}
@@ -182,37 +331,115 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 	err = sesschan.RelayStart(remote_name)
 
 	if err != nil {
-		fmt.Fprintf(sesschan, "Failed to Initialize Session.\r\n")
+		fmt.Fprintf(out, "Failed to Initialize Session.\r\n")
 		sesschan.Close()
 		return
 	}
-	WriteAuthLog("Connecting to remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
-	fmt.Fprintf(sesschan, "Connecting to %s\r\n", remote_name)
+	if !execMode {
+		fmt.Fprintf(out, "Connecting to %s\r\n", remote_name)
+	}
+	var prompt io.ReadWriter = sesschan
+	if execMode {
+		prompt = nil
+	}
+	client, address, err := dialRemote(conn, remote_name, remote, prompt, agentForwarding)
+	if err != nil {
+		fmt.Fprintf(out, "Connect failed: %v\r\n", err)
+		sesschan.Close()
+		return
+	}
+	defer client.Close()
+	if !execMode && len(remote.ConnectAddresses()) > 1 {
+		fmt.Fprintf(out, "Connected to %s via %s\r\n", remote_name, address)
+	}
+	sesschan.LogEvent("Connected", "Target", remote_name, "Address", address)
+
+	if allowX11 {
+		ForwardX11(conn, sesschan, client, remote_name)
+	}
+	if onwardAgent {
+		ForwardAgent(conn, sesschan, client, remote_name)
+	}
+	reqs := filterRequests(conn, sesschan, maskedReqs, reqsDone, remote_name, allowX11, policies...)
+
+	if remote_action == "session" {
+		channel2, reqs2, err := client.OpenChannel("session", []byte{})
+		if err != nil {
+			fmt.Fprintf(out, "Remote session setup failed: %v\r\n", err)
+			sesschan.Close()
+			return
+		}
+		if onwardAgent {
+			if ok, err := channel2.SendRequest("auth-agent-req@openssh.com", true, nil); err != nil || !ok {
+				sesschan.LogEvent("Agent forwarding refused by the target", "Target", remote_name)
+			}
+		}
+		WriteAuthLog("Connected to remote for relay (%s) by %s from %s.", address, sshConn.User(), sshConn.RemoteAddr())
+		defer WriteAuthLog("Disconnected from remote for relay (%s) by %s from %s.", address, sshConn.User(), sshConn.RemoteAddr())
+
+		proxy(reqs, reqs2, sesschan, channel2, client)
+	} else if remote_action == "exec" {
+		WriteAuthLog("Connected to remote for command execution (%s) by %s from %s.", address, sshConn.User(), sshConn.RemoteAddr())
+		defer WriteAuthLog("Disconnected from remote for command execution (%s) by %s from %s.", address, sshConn.User(), sshConn.RemoteAddr())
+
+		ExecRelay(reqs, execReq, sesschan, client, remote_name, execCommand, onwardAgent, nil)
+	} else if remote_action == "scp" {
+		WriteAuthLog("Connected to remote for scp %s (%s) by %s from %s.", scp.Direction(), address, sshConn.User(), sshConn.RemoteAddr())
+		defer WriteAuthLog("Disconnected from remote for scp %s (%s) by %s from %s.", scp.Direction(), address, sshConn.User(), sshConn.RemoteAddr())
+
+		scp.channel, scp.remote = sesschan, remote_name
+		ExecRelay(reqs, execReq, sesschan, client, remote_name, scp.Command, false, scp)
+	}
+
+}
+
+// dialRemote connects to the remote server for conn, and returns the
+// connect path used. The password of the remote, when it is not passed
+// through, is asked on prompt, or fails when prompt is nil (exec and sftp
+// sessions).
+func dialRemote(conn *BastionConn, remote_name string, remote SSHConfigServer, prompt io.ReadWriter, agentForwarding bool) (*ssh.Client, string, error) {
+	config := conn.Config
+	WriteAuthLog("Connecting to remote for relay (%s) by %s from %s.", strings.Join(remote.ConnectAddresses(), ", "), conn.User(), conn.RemoteAddr())
 
 	timeout, _ := time.ParseDuration("30s")
 	if len(config.Global.ConnectTimeout) > 0 {
-		timeout, err = time.ParseDuration(config.Global.ConnectTimeout)
+		t, err := time.ParseDuration(config.Global.ConnectTimeout)
 		if err != nil {
 			log.Printf("Ignored invalid timeout in configuration: %v.\r\n", err)
+		} else {
+			timeout = t
 		}
 	}
 
 	var clientConfig *ssh.ClientConfig
 
 	clientConfig = &ssh.ClientConfig{
-		User: sshConn.User(),
+		User: conn.User(),
 		Auth: []ssh.AuthMethod{
 			ssh.PasswordCallback(func() (secret string, err error) {
-				if secret, ok := sshConn.Permissions.Extensions["password"]; ok && config.Global.PassPassword {
+				if secret, ok := conn.Permissions.Extensions["password"]; ok && config.Global.PassPassword {
 					return secret, nil
+				} else if prompt == nil {
+					return "", fmt.Errorf("No password available for %s", remote_name)
 				} else {
-					t := terminal.NewTerminal(sesschan, "")
+					t := terminal.NewTerminal(prompt, "")
 					s, err := t.ReadPassword(fmt.Sprintf("%s@%s password: ", clientConfig.User, remote_name))
 					return s, err
 				}
 			}),
 		},
 		HostKeyCallback: func(hostname string, remote_addr net.Addr, key ssh.PublicKey) error {
+			if cert, ok := key.(*ssh.Certificate); ok {
+				if trusted, err := checkHostCert(config, remote_name, hostname, remote, cert); trusted && err != nil {
+					WriteAuthLog("Host certificate validation failed for remote %s by user %s from %s: %v.", hostname, conn.User(), remote_addr, err)
+					return fmt.Errorf("HOST CERTIFICATE VALIDATION FAILED: %v", err)
+				} else if trusted {
+					return nil
+				}
+				// Not signed by a trusted CA, the key of the certificate
+				// is checked.
+				key = cert.Key
+			}
 			for _, k := range remote.HostPubKeys {
 				hostKeyData := []byte(k)
 				hostKey, _, _, _, err := ssh.ParseAuthorizedKey(hostKeyData)
@@ -224,10 +451,12 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 					return nil
 				}
 			}
-			WriteAuthLog("Host key validation failed for remote %s by user %s from %s.", remote.ConnectPath, sshConn.User(), remote_addr)
+			if len(remote.HostPubKeys) == 0 && config.Global.HostKeyTOFU {
+				return knownHosts.Check(config, remote_name, hostname, key)
+			}
+			WriteAuthLog("Host key validation failed for remote %s by user %s from %s.", hostname, conn.User(), remote_addr)
 			return fmt.Errorf("HOST KEY VALIDATION FAILED - POSSIBLE MITM BETWEEN RELAY AND REMOTE")
 		},
-		Timeout: timeout,
 	}
 
 	if config.Global.IgnoreHostPubKeys {
@@ -248,39 +477,70 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
 	}
 
 	if agentForwarding {
-		agentChan, agentReqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
+		agentChan, agentReqs, err := conn.OpenChannel("auth-agent@openssh.com", nil)
 
 		if err == nil {
 			defer agentChan.Close()
 
 			go ssh.DiscardRequests(agentReqs)
-			ag := agent.NewClient(agentChan)
+			ag := newRestrictedAgent(conn, remote_name, agent.NewClient(agentChan))
+			defer ag.Close()
 			clientConfig.Auth = append([]ssh.AuthMethod{ssh.PublicKeysCallback(ag.Signers)}, clientConfig.Auth...)
 		}
 
 	}
 
-	client, err := ssh.Dial("tcp", remote.ConnectPath, clientConfig)
-	if err != nil {
-		fmt.Fprintf(sesschan, "Connect failed: %v\r\n", err)
-		sesschan.Close()
-		return
+	// The deadline of the attempt is lifted once the host key is received,
+	// the connection doesn't fail over to the next path afterwards.
+	var netConn net.Conn
+	var hostKeyReceived bool
+	checkHostKey := clientConfig.HostKeyCallback
+	clientConfig.HostKeyCallback = func(hostname string, remote_addr net.Addr, key ssh.PublicKey) error {
+		hostKeyReceived = true
+		netConn.SetDeadline(time.Time{})
+		return checkHostKey(hostname, remote_addr, key)
+	}
+	tried := map[string]bool{}
+	failed := func(address string, err error) {
+		tried[address] = true
+		WriteAuthLog("Failed to connect to remote %s (%s) by %s from %s: %v.", remote_name, address, conn.User(), conn.RemoteAddr(), err)
+		if prompt != nil {
+			fmt.Fprintf(prompt, "Connection to %s failed: %v\r\n", address, err)
+		}
 	}
-	defer client.Close()
 
-	if remote_action == "session" {
-		channel2, reqs2, err := client.OpenChannel("session", []byte{})
+	attemptTimeout := remote.attemptTimeout(timeout)
+	addresses := remote.connectAttempts()
+	for {
+		var address string
+		var err error
+		netConn, address, err = dialConnectPaths(addresses, remote.HappyEyeballs, attemptTimeout, failed)
 		if err != nil {
-			fmt.Fprintf(sesschan, "Remote session setup failed: %v\r\n", err)
-			sesschan.Close()
-			return
+			return nil, "", err
+		}
+		tried[address] = true
+		remaining := []string{}
+		for _, a := range addresses {
+			if !tried[a] {
+				remaining = append(remaining, a)
+			}
 		}
-		WriteAuthLog("Connected to remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
-		defer WriteAuthLog("Disconnected from remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
+		addresses = remaining
 
-		proxy(maskedReqs, reqs2, sesschan, channel2, client)
+		// The host keys are checked against the address used.
+		clientConfig.HostKeyAlgorithms = pinnedHostKeyAlgorithms(config, remote_name, remote, address)
+		hostKeyReceived = false
+		netConn.SetDeadline(time.Now().Add(attemptTimeout))
+		c, chans, reqs, err := ssh.NewClientConn(netConn, address, clientConfig)
+		if err == nil {
+			return ssh.NewClient(c, chans, reqs), address, nil
+		}
+		netConn.Close()
+		if hostKeyReceived || len(addresses) == 0 {
+			return nil, address, err
+		}
+		failed(address, err)
 	}
-
 }
 
 type readCloser struct {
@@ -2,24 +2,28 @@ module ssh-bastion
 
 go 1.17
 
+require (
+	github.com/go-ldap/ldap v3.0.3+incompatible
+	github.com/jessevdk/go-flags v1.5.0
+	github.com/pkg/sftp v1.13.4
+	golang.org/x/crypto v0.0.0-20220208050332-20e1d8d225ab
+	gopkg.in/yaml.v2 v2.4.0
+)
+
 require (
 	github.com/AlecAivazis/survey/v2 v2.3.2 // indirect
 	github.com/daviddengcn/go-colortext v0.0.0-20180409174941-186a3d44e920 // indirect
 	github.com/dixonwille/wlog/v3 v3.0.1 // indirect
 	github.com/dixonwille/wmenu/v5 v5.1.0 // indirect
-	github.com/go-ldap/ldap v3.0.3+incompatible // indirect
-	github.com/jessevdk/go-flags v1.5.0 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.2 // indirect
 	github.com/mattn/go-isatty v0.0.11 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
-	github.com/pkg/sftp v1.13.4 // indirect
-	golang.org/x/crypto v0.0.0-20220208050332-20e1d8d225ab // indirect
 	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 	golang.org/x/term v0.0.0-20210503060354-a79de5458b56 // indirect
 	golang.org/x/text v0.3.6 // indirect
 	gopkg.in/asn1-ber.v1 v1.0.0-20181015200546-f715ec2f112d // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
 replace golang.org/x/crypto v0.0.0-20220208050332-20e1d8d225ab => github.com/akiuni/golang-x-crypto v0.0.0-20220126233154-a96af8f07497
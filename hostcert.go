@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Targets presenting an OpenSSH host certificate signed by one of the
+// trusted_host_ca_keys, or of the group_trusted_host_ca_keys of their group,
+// are accepted without host_pubkeys. One of the principals of the
+// certificate must be the host name of the connect path used, the name of
+// the server or its full_name.
+
+// hostCAKeys returns the CA keys trusted for the host certificates of a
+// server.
+func hostCAKeys(config *SSHConfig, server SSHConfigServer) []string {
+	keys := config.Global.TrustedHostCAKeys
+	if len(server.Group) > 0 {
+		keys = append(append([]string{}, keys...), config.Global.GroupTrustedHostCAKeys[server.Group]...)
+	}
+	return keys
+}
+
+// checkHostCert verifies the host certificate presented by a server reached
+// at address. It returns false when the certificate is not signed by a trusted CA, the
+// error tells then if it is valid.
+func checkHostCert(config *SSHConfig, name string, address string, server SSHConfigServer, cert *ssh.Certificate) (bool, error) {
+	trusted := false
+	for _, k := range hostCAKeys(config, server) {
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+		if err == nil && bytes.Equal(cert.SignatureKey.Marshal(), caKey.Marshal()) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return false, nil
+	}
+	if cert.CertType != ssh.HostCert {
+		return true, fmt.Errorf("Certificate is not a host certificate")
+	}
+
+	candidates := []string{name}
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		candidates = append(candidates, host)
+	}
+	if len(server.FullName) > 0 {
+		candidates = append(candidates, server.FullName)
+	}
+	principal := ""
+	for _, c := range candidates {
+		if contains(cert.ValidPrincipals, c) {
+			principal = c
+			break
+		}
+	}
+	if len(principal) == 0 {
+		return true, fmt.Errorf("No certificate principal matches %s", name)
+	}
+
+	var revokedErr error
+	checker := &ssh.CertChecker{
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			revoked, err := isCertRevoked(config.Global.RevokedHostCertsFile, cert)
+			if err != nil {
+				// Fail closed when the revocation list can't be read.
+				revokedErr = err
+				return true
+			}
+			return revoked
+		},
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		if revokedErr != nil {
+			log.Printf("Unable to read revoked certificates file (%s): %s", config.Global.RevokedHostCertsFile, revokedErr)
+		}
+		return true, err
+	}
+	return true, nil
+}
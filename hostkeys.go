@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// With host_key_tofu, the host keys of the servers without host_pubkeys are
+// recorded in storage_path/.known_hosts on the first connection, and pinned
+// afterwards. A different key is refused, raises an alert and is kept in
+// storage_path/.known_hosts.pending until an administrator accepts it with
+// the accept-hostkey admin command. Like OpenSSH, only the types of the keys
+// pinned for a target are negotiated with it, so a target offering a new type
+// of key keeps presenting the pinned one.
+
+var errHostKeyChanged = errors.New("HOST KEY HAS CHANGED - POSSIBLE MITM BETWEEN RELAY AND REMOTE, THE NEW KEY MUST BE ACCEPTED BY AN ADMINISTRATOR")
+
+type knownHost struct {
+	Address string
+	Key     ssh.PublicKey
+	Comment string
+}
+
+func (h knownHost) String() string {
+	return fmt.Sprintf("%s %s %s %s", h.Address, h.Key.Type(), ssh.FingerprintSHA256(h.Key), h.Comment)
+}
+
+type hostKeyStore struct {
+	lock sync.Mutex
+}
+
+var knownHosts = &hostKeyStore{}
+
+func knownHostsFile(config *SSHConfig) string {
+	return config.Global.StoragePath + "/.known_hosts"
+}
+
+func pendingHostsFile(config *SSHConfig) string {
+	return config.Global.StoragePath + "/.known_hosts.pending"
+}
+
+// Check verifies the key presented by the server name at address. The key
+// is recorded if the address is not known yet.
+func (s *hostKeyStore) Check(config *SSHConfig, name string, address string, key ssh.PublicKey) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	address = knownhosts.Normalize(address)
+	known, err := readKnownHosts(knownHostsFile(config))
+	if err != nil {
+		return fmt.Errorf("Unable to read the known hosts: %v", err)
+	}
+	pinned := []knownHost{}
+	for _, h := range known {
+		if h.Address != address {
+			continue
+		}
+		if bytes.Equal(h.Key.Marshal(), key.Marshal()) {
+			return nil
+		}
+		pinned = append(pinned, h)
+	}
+	if len(pinned) > 0 {
+		return s.refuse(config, name, address, pinned, key)
+	}
+
+	known = append(known, knownHost{address, key, name + " " + time.Now().Format(time.RFC3339)})
+	if err := writeKnownHosts(knownHostsFile(config), known); err != nil {
+		return fmt.Errorf("Unable to record the host key: %v", err)
+	}
+	WriteAuthLog("Recorded host key %s %s of %s (%s) on first use.", key.Type(), ssh.FingerprintSHA256(key), name, address)
+	return nil
+}
+
+// refuse records a changed key in the pending keys. The alert is only raised
+// the first time a given key is seen.
+func (s *hostKeyStore) refuse(config *SSHConfig, name string, address string, keys []knownHost, key ssh.PublicKey) error {
+	pinned := keys[0]
+	for _, h := range keys {
+		if h.Key.Type() == key.Type() {
+			pinned = h
+		}
+	}
+	WriteAuthLog("Host key of %s (%s) changed: %s %s presented, %s %s pinned, connection refused.", name, address, key.Type(), ssh.FingerprintSHA256(key), pinned.Key.Type(), ssh.FingerprintSHA256(pinned.Key))
+
+	pending, err := readKnownHosts(pendingHostsFile(config))
+	if err != nil {
+		return errHostKeyChanged
+	}
+	entries := []knownHost{}
+	for _, h := range pending {
+		if h.Address == address {
+			if bytes.Equal(h.Key.Marshal(), key.Marshal()) {
+				return errHostKeyChanged
+			}
+			continue
+		}
+		entries = append(entries, h)
+	}
+	entries = append(entries, knownHost{address, key, name + " " + time.Now().Format(time.RFC3339)})
+	if err := writeKnownHosts(pendingHostsFile(config), entries); err != nil {
+		WriteAuthLog("Unable to record the pending host key of %s (%s): %v.", name, address, err)
+	}
+	RaiseAlert(config, "Host key of %s (%s) changed to %s %s, review it with the hostkeys admin command", name, address, key.Type(), ssh.FingerprintSHA256(key))
+	return errHostKeyChanged
+}
+
+// Keys returns the keys pinned for address.
+func (s *hostKeyStore) Keys(config *SSHConfig, address string) ([]ssh.PublicKey, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	address = knownhosts.Normalize(address)
+	known, err := readKnownHosts(knownHostsFile(config))
+	if err != nil {
+		return nil, err
+	}
+	keys := []ssh.PublicKey{}
+	for _, h := range known {
+		if h.Address == address {
+			keys = append(keys, h.Key)
+		}
+	}
+	return keys, nil
+}
+
+// List returns the pinned keys and the pending ones.
+func (s *hostKeyStore) List(config *SSHConfig) ([]knownHost, []knownHost, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	known, err := readKnownHosts(knownHostsFile(config))
+	if err != nil {
+		return nil, nil, err
+	}
+	pending, err := readKnownHosts(pendingHostsFile(config))
+	return known, pending, err
+}
+
+// Accept pins the pending keys of target, a server name (for each of its
+// connect paths) or an address.
+func (s *hostKeyStore) Accept(config *SSHConfig, target string) ([]knownHost, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	addresses := []string{target}
+	if server, ok := config.Servers[target]; ok {
+		addresses = server.ConnectAddresses()
+	}
+	for i, a := range addresses {
+		addresses[i] = knownhosts.Normalize(a)
+	}
+
+	pending, err := readKnownHosts(pendingHostsFile(config))
+	if err != nil {
+		return nil, err
+	}
+	accepted := []knownHost{}
+	remaining := []knownHost{}
+	for _, h := range pending {
+		if contains(addresses, h.Address) {
+			accepted = append(accepted, h)
+		} else {
+			remaining = append(remaining, h)
+		}
+	}
+	if len(accepted) == 0 {
+		return nil, fmt.Errorf("No pending host key for %s", strings.Join(addresses, ", "))
+	}
+
+	known, err := readKnownHosts(knownHostsFile(config))
+	if err != nil {
+		return nil, err
+	}
+	// The accepted keys replace the pinned keys of the same type.
+	entries := []knownHost{}
+	for _, h := range known {
+		if !containsKnownHost(accepted, h) {
+			entries = append(entries, h)
+		}
+	}
+	entries = append(entries, accepted...)
+	if err := writeKnownHosts(knownHostsFile(config), entries); err != nil {
+		return nil, err
+	}
+	if err := writeKnownHosts(pendingHostsFile(config), remaining); err != nil {
+		return nil, err
+	}
+	for _, h := range accepted {
+		WriteAuthLog("Accepted host key %s %s of %s.", h.Key.Type(), ssh.FingerprintSHA256(h.Key), h.Address)
+	}
+	return accepted, nil
+}
+
+func containsKnownHost(hosts []knownHost, host knownHost) bool {
+	for _, h := range hosts {
+		if h.Address == host.Address && h.Key.Type() == host.Key.Type() {
+			return true
+		}
+	}
+	return false
+}
+
+// Host key algorithms negotiated for each type of pinned key.
+var hostKeyTypeAlgorithms = map[string][]string{
+	ssh.KeyAlgoRSA: {ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSA},
+}
+
+// Host certificate algorithms, negotiated first when host CAs are trusted.
+var hostCertAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+	ssh.CertSigAlgoRSASHA2512v01, ssh.CertSigAlgoRSASHA2256v01, ssh.CertSigAlgoRSAv01,
+	ssh.CertAlgoDSAv01,
+}
+
+// pinnedHostKeyAlgorithms returns the host key algorithms to negotiate with
+// the server name at address: the ones of the types of its host_pubkeys, or
+// of the keys recorded with host_key_tofu. It returns nil when no key is
+// pinned, to negotiate any of them.
+func pinnedHostKeyAlgorithms(config *SSHConfig, name string, server SSHConfigServer, address string) []string {
+	if config.Global.IgnoreHostPubKeys {
+		return nil
+	}
+	keys := []ssh.PublicKey{}
+	for _, k := range server.HostPubKeys {
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(server.HostPubKeys) == 0 && config.Global.HostKeyTOFU {
+		var err error
+		if keys, err = knownHosts.Keys(config, address); err != nil {
+			log.Printf("Unable to read the known hosts: %v", err)
+			return nil
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	algorithms := []string{}
+	if len(hostCAKeys(config, server)) > 0 {
+		algorithms = append(algorithms, hostCertAlgorithms...)
+	}
+	for _, k := range keys {
+		if a, ok := hostKeyTypeAlgorithms[k.Type()]; ok {
+			algorithms = appendUnique(algorithms, a...)
+		} else {
+			algorithms = appendUnique(algorithms, k.Type())
+		}
+	}
+	return algorithms
+}
+
+func readKnownHosts(file string) ([]knownHost, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := []knownHost{}
+	for len(data) > 0 {
+		_, hosts, key, comment, rest, err := ssh.ParseKnownHosts(data)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for _, h := range hosts {
+			entries = append(entries, knownHost{h, key, comment})
+		}
+		data = rest
+	}
+	return entries, nil
+}
+
+// writeKnownHosts replaces file, through a temporary file so it is never
+// left half written.
+func writeKnownHosts(file string, entries []knownHost) error {
+	var buf bytes.Buffer
+	for _, h := range entries {
+		key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(h.Key)))
+		fmt.Fprintf(&buf, "%s %s %s\n", h.Address, key, h.Comment)
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
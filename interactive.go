@@ -30,7 +30,7 @@ func InteractiveDataSession(c *LogChannel, client *ssh.Client) error {
 	d.client = client
 	d.mode = "sftp"
 
-	data_path := filepath.Clean(config.Global.StoragePath + "/" + c.UserName)
+	data_path := filepath.Clean(c.Config.Global.StoragePath + "/" + c.UserName)
 	os.MkdirAll(data_path, 0700)
 
 	for {
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// The keyscan command connects to the connect paths of the servers, collects
+// the host keys of every algorithm they offer, shows the differences with
+// their host_pubkeys and, once approved, writes them in the file declaring
+// each server: inline, or in key files referenced with file:.
+
+// Host key algorithms asked to the servers, one connection each.
+var keyscanAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.SigAlgoRSASHA2512, ssh.SigAlgoRSASHA2256, ssh.SigAlgoRSA,
+	ssh.KeyAlgoDSA,
+}
+
+// Names of the key files written with --key-dir, after the ones of OpenSSH.
+var keyscanFileNames = map[string]string{
+	ssh.KeyAlgoED25519:  "ssh_host_ed25519_key.pub",
+	ssh.KeyAlgoECDSA256: "ssh_host_ecdsa_key.pub",
+	ssh.KeyAlgoECDSA384: "ssh_host_ecdsa384_key.pub",
+	ssh.KeyAlgoECDSA521: "ssh_host_ecdsa521_key.pub",
+	ssh.KeyAlgoRSA:      "ssh_host_rsa_key.pub",
+	ssh.KeyAlgoDSA:      "ssh_host_dsa_key.pub",
+}
+
+// keyscanFileName returns the name of the key file of a key type, derived from
+// the type when OpenSSH has no name for it.
+func keyscanFileName(keyType string) string {
+	if name, ok := keyscanFileNames[keyType]; ok {
+		return name
+	}
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(keyType))
+	return "ssh_host_" + name + "_key.pub"
+}
+
+const keyscanParallel = 8
+
+var errKeyScanned = errors.New("host key scanned")
+
+type keyscanTarget struct {
+	Name   string
+	File   string
+	Path   []string
+	Server SSHConfigServer
+
+	Pinned  []ssh.PublicKey
+	Scanned []ssh.PublicKey
+	Err     error
+	// Connect paths which couldn't be scanned, when others could.
+	Failed []string
+}
+
+// keys returns the keys to write: the scanned ones, and the pinned ones
+// when some connect paths couldn't be scanned, as they may still be offered
+// there.
+func (t *keyscanTarget) keys() []ssh.PublicKey {
+	if len(t.Failed) == 0 {
+		return t.Scanned
+	}
+	keys := append([]ssh.PublicKey{}, t.Scanned...)
+	for _, k := range t.Pinned {
+		if !containsKey(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// changed tells if the keys to write differ from the pinned ones.
+func (t *keyscanTarget) changed() bool {
+	if t.Err != nil {
+		return false
+	}
+	keys := t.keys()
+	if len(t.Pinned) != len(keys) {
+		return true
+	}
+	for _, k := range keys {
+		if !containsKey(t.Pinned, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// hostPubKeys returns the host_pubkeys entries to write for the scanned
+// keys, writing the key files when keyDir is set.
+func (t *keyscanTarget) hostPubKeys(keyDir string) ([]string, error) {
+	entries := []string{}
+	used := map[string]bool{}
+	for _, k := range t.keys() {
+		key := string(ssh.MarshalAuthorizedKey(k))
+		if len(keyDir) == 0 {
+			entries = append(entries, strings.TrimSpace(key))
+			continue
+		}
+		dir := filepath.Join(keyDir, t.Name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		// A key kept while a connect path failed can have the type of a
+		// scanned one: the next ones get a number.
+		name := keyscanFileName(k.Type())
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s_%d.pub", strings.TrimSuffix(keyscanFileName(k.Type()), ".pub"), n)
+		}
+		used[name] = true
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(key), 0644); err != nil {
+			return nil, err
+		}
+		entries = append(entries, "file:"+file)
+	}
+	return entries, nil
+}
+
+type keyscanCommand struct {
+	Group   string `short:"g" long:"group" description:"Only scan the servers of this group"`
+	KeyDir  string `short:"d" long:"key-dir" description:"Write the keys in files of this directory, referenced with file: (keys are written inline by default)"`
+	Timeout int    `short:"t" long:"timeout" description:"Connection timeout in seconds" default:"10"`
+	DryRun  bool   `short:"n" long:"dry-run" description:"Only show the changes"`
+	Yes     bool   `short:"y" long:"yes" description:"Write the changes without asking"`
+}
+
+func (c *keyscanCommand) Execute(args []string) error {
+	config, err := readConfigFile(opts.Config)
+	if err != nil {
+		return err
+	}
+	targets, err := keyscanTargets(config, c.Group, args)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.New("No server to scan")
+	}
+
+	timeout := time.Duration(c.Timeout) * time.Second
+	sem := make(chan struct{}, keyscanParallel)
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t *keyscanTarget) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			t.Scanned, t.Failed, t.Err = scanServerHostKeys(t.Server, timeout)
+		}(t)
+	}
+	wg.Wait()
+
+	changes := []*keyscanTarget{}
+	for _, t := range targets {
+		printKeyscanDiff(t)
+		if t.changed() {
+			changes = append(changes, t)
+		}
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return nil
+	}
+	if c.DryRun {
+		fmt.Printf("%d server(s) to update\n", len(changes))
+		return nil
+	}
+	if !c.Yes {
+		fmt.Printf("Write the host keys of %d server(s)? [y/N] ", len(changes))
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Println("Nothing written")
+			return nil
+		}
+	}
+
+	files := []string{}
+	byFile := map[string][]*keyscanTarget{}
+	for _, t := range changes {
+		if _, ok := byFile[t.File]; !ok {
+			files = append(files, t.File)
+		}
+		byFile[t.File] = append(byFile[t.File], t)
+	}
+	for _, file := range files {
+		if err := writeKeyscanFile(file, byFile[file], c.KeyDir); err != nil {
+			return fmt.Errorf("Unable to update %s: %v", file, err)
+		}
+		fmt.Printf("Updated %d server(s) in %s\n", len(byFile[file]), file)
+	}
+	return nil
+}
+
+// keyscanTargets lists the servers to scan with the file declaring them,
+// the ones of group only if it is set, and the ones named in names if any.
+func keyscanTargets(config *SSHConfig, group string, names []string) ([]*keyscanTarget, error) {
+	targets := map[string]*keyscanTarget{}
+	if len(group) == 0 {
+		for name, server := range config.Servers {
+			targets[name] = &keyscanTarget{Name: name, File: opts.Config, Path: []string{"servers", name}, Server: server}
+		}
+	}
+
+	groups := config.Groups
+	if len(group) > 0 {
+		groups = []string{group}
+	}
+	for _, g := range groups {
+		groupFile := config.Global.GroupPath + "/" + g + ".yaml"
+		groupData, err := ioutil.ReadFile(groupFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open group file: %s", err)
+		}
+		var t map[string]SSHConfigServer
+		if err := yaml.Unmarshal(groupData, &t); err != nil {
+			return nil, fmt.Errorf("Unable to parse YAML group file %s: %s", groupFile, err)
+		}
+		for name, server := range t {
+			// Servers declared in the main file override the ones from
+			// groups.
+			if _, ok := config.Servers[name]; ok {
+				continue
+			}
+			if _, ok := targets[name]; !ok {
+				targets[name] = &keyscanTarget{Name: name, File: groupFile, Path: []string{name}, Server: server}
+			}
+		}
+	}
+
+	if len(names) > 0 {
+		selected := map[string]*keyscanTarget{}
+		for _, name := range names {
+			t, ok := targets[name]
+			if !ok {
+				return nil, fmt.Errorf("Unknown server %s", name)
+			}
+			selected[name] = t
+		}
+		targets = selected
+	}
+
+	list := []*keyscanTarget{}
+	for _, t := range targets {
+		for _, entry := range t.Server.HostPubKeys {
+			keys, err := parseHostPubKeys(entry)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s: %v\n", t.File, t.Name, err)
+			}
+			t.Pinned = append(t.Pinned, keys...)
+		}
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// parseHostPubKeys returns the keys of a host_pubkeys entry.
+func parseHostPubKeys(entry string) ([]ssh.PublicKey, error) {
+	data, err := loadKey(entry)
+	if err != nil {
+		return nil, err
+	}
+	keys := []ssh.PublicKey{}
+	rest := []byte(data)
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return keys, fmt.Errorf("Invalid host key %s: %v", entry, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanServerHostKeys collects the host keys offered on the connect paths of
+// server. The paths which can't be scanned are returned, the scan fails if
+// none of them can.
+func scanServerHostKeys(server SSHConfigServer, timeout time.Duration) ([]ssh.PublicKey, []string, error) {
+	keys := []ssh.PublicKey{}
+	errs := []string{}
+	for _, address := range server.ConnectAddresses() {
+		scanned, err := scanHostKeys(address, timeout)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", address, err))
+			continue
+		}
+		for _, k := range scanned {
+			if !containsKey(keys, k) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, errors.New(strings.Join(errs, "; "))
+	}
+	return keys, errs, nil
+}
+
+// scanHostKeys collects the host keys offered by the server at address.
+func scanHostKeys(address string, timeout time.Duration) ([]ssh.PublicKey, error) {
+	keys := []ssh.PublicKey{}
+	for _, algo := range keyscanAlgorithms {
+		key, err := scanHostKey(address, algo, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if key != nil && !containsKey(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("No host key offered")
+	}
+	return keys, nil
+}
+
+// scanHostKey returns the host key of the server for algo, or nil if it
+// doesn't offer it. The handshake is stopped once the key is received, any
+// other failure of the handshake is returned.
+func scanHostKey(address string, algo string, timeout time.Duration) (ssh.PublicKey, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	var key ssh.PublicKey
+	clientConfig := &ssh.ClientConfig{
+		User:              "keyscan",
+		HostKeyAlgorithms: []string{algo},
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			key = k
+			return errKeyScanned
+		},
+		Timeout: timeout,
+	}
+	// The handshake errors are not wrapped: the key received tells apart the
+	// stop of the handshake by the callback.
+	_, _, _, err = ssh.NewClientConn(conn, address, clientConfig)
+	if key != nil {
+		return key, nil
+	}
+	if strings.Contains(err.Error(), "no common algorithm for host key") {
+		return nil, nil
+	}
+	return nil, err
+}
+
+func printKeyscanDiff(t *keyscanTarget) {
+	fmt.Printf("%s (%s, %s)\n", t.Name, strings.Join(t.Server.ConnectAddresses(), ", "), t.File)
+	if t.Err != nil {
+		fmt.Printf("  ! scan failed: %v\n", t.Err)
+		return
+	}
+	for _, f := range t.Failed {
+		fmt.Printf("  ! scan failed: %s\n", f)
+	}
+	for _, k := range t.Scanned {
+		mark := "+"
+		if containsKey(t.Pinned, k) {
+			mark = " "
+		}
+		fmt.Printf("  %s %s %s\n", mark, k.Type(), ssh.FingerprintSHA256(k))
+	}
+	for _, k := range t.Pinned {
+		if containsKey(t.Scanned, k) {
+			continue
+		}
+		if len(t.Failed) > 0 {
+			fmt.Printf("    %s %s (kept, not offered by the paths scanned)\n", k.Type(), ssh.FingerprintSHA256(k))
+		} else {
+			fmt.Printf("  - %s %s\n", k.Type(), ssh.FingerprintSHA256(k))
+		}
+	}
+}
+
+// writeKeyscanFile updates the host_pubkeys of targets in file. The file is
+// edited as text to keep its layout and comments, and parsed again to make
+// sure the result is the expected one before it is replaced.
+func writeKeyscanFile(file string, targets []*keyscanTarget, keyDir string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	expected := map[string][]string{}
+	for _, t := range targets {
+		entries, err := t.hostPubKeys(keyDir)
+		if err != nil {
+			return err
+		}
+		data, err = setYAMLHostPubKeys(data, t.Path, entries)
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.Name, err)
+		}
+		expected[t.Name] = entries
+	}
+
+	servers := map[string]SSHConfigServer{}
+	if file == opts.Config {
+		var config SSHConfig
+		err = yaml.Unmarshal(data, &config)
+		servers = config.Servers
+	} else {
+		err = yaml.Unmarshal(data, &servers)
+	}
+	if err != nil {
+		return fmt.Errorf("Edited file is not valid: %v", err)
+	}
+	for name, entries := range expected {
+		if !reflect.DeepEqual(servers[name].HostPubKeys, entries) {
+			return fmt.Errorf("%s: Unable to edit host_pubkeys", name)
+		}
+	}
+
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, info.Mode()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// yamlLineIndent returns the indentation of a line, and false for the blank
+// and comment lines.
+func yamlLineIndent(line string) (int, bool) {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(strings.TrimSpace(trimmed)) == 0 || strings.HasPrefix(trimmed, "#") {
+		return 0, false
+	}
+	return len(line) - len(trimmed), true
+}
+
+// yamlChild finds the key among the children of the block lines[from:to].
+func yamlChild(lines []string, from int, to int, key string) (int, int) {
+	indent := -1
+	for i := from; i < to; i++ {
+		ind, ok := yamlLineIndent(lines[i])
+		if !ok {
+			continue
+		}
+		if indent < 0 {
+			indent = ind
+		}
+		if ind != indent {
+			continue
+		}
+		trimmed := strings.TrimSpace(lines[i])
+		for _, k := range []string{key, `"` + key + `"`, "'" + key + "'"} {
+			if strings.HasPrefix(trimmed, k+":") {
+				return i, ind
+			}
+		}
+	}
+	return -1, indent
+}
+
+// yamlBlockEnd returns the end of the block of the key at line idx. With
+// seq, sequence items at the indentation of the key belong to it.
+func yamlBlockEnd(lines []string, idx int, indent int, seq bool) int {
+	last := idx
+	for i := idx + 1; i < len(lines); i++ {
+		ind, ok := yamlLineIndent(lines[i])
+		if !ok {
+			continue
+		}
+		if ind > indent || (seq && ind == indent && strings.HasPrefix(strings.TrimSpace(lines[i]), "-")) {
+			last = i
+			continue
+		}
+		break
+	}
+	return last + 1
+}
+
+// setYAMLHostPubKeys replaces the host_pubkeys list of the server at path,
+// or adds it at the end of the server.
+func setYAMLHostPubKeys(data []byte, path []string, keys []string) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+	from, to, indent := 0, len(lines), -1
+	for _, key := range path {
+		idx, ind := yamlChild(lines, from, to, key)
+		if idx < 0 {
+			return nil, fmt.Errorf("%s not found", strings.Join(path, "."))
+		}
+		from, to, indent = idx+1, yamlBlockEnd(lines, idx, ind, false), ind
+	}
+
+	idx, keyIndent := yamlChild(lines, from, to, "host_pubkeys")
+	if keyIndent < 0 {
+		keyIndent = indent + 4
+	}
+	itemIndent := keyIndent + 4
+	start, end := to, to
+	if idx >= 0 {
+		start, end = idx, yamlBlockEnd(lines, idx, keyIndent, true)
+		for i := idx + 1; i < end; i++ {
+			if ind, ok := yamlLineIndent(lines[i]); ok {
+				itemIndent = ind
+				break
+			}
+		}
+	}
+
+	block := []string{strings.Repeat(" ", keyIndent) + "host_pubkeys:"}
+	for _, k := range keys {
+		block = append(block, fmt.Sprintf("%s- %q", strings.Repeat(" ", itemIndent), k))
+	}
+	result := append([]string{}, lines[:start]...)
+	result = append(result, block...)
+	result = append(result, lines[end:]...)
+	return []byte(strings.Join(result, "\n")), nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ldap "github.com/go-ldap/ldap"
+)
+
+// ldapClient keeps a small pool of idle LDAP connections. Each use of a
+// connection starts with a bind, so a connection can be reused whatever the
+// identity bound by the previous user. The pool is emptied when the LDAP
+// settings change on reload.
+type ldapClient struct {
+	lock     sync.Mutex
+	settings string
+	idle     []*ldap.Conn
+}
+
+var ldapPool = &ldapClient{}
+
+func ldapServers(config *SSHConfig) []string {
+	if len(config.Global.LDAP_Servers) > 0 {
+		return config.Global.LDAP_Servers
+	}
+	if len(config.Global.LDAP_Server) > 0 {
+		return []string{config.Global.LDAP_Server}
+	}
+	return nil
+}
+
+func ldapTimeout(config *SSHConfig) time.Duration {
+	timeout := 10 * time.Second
+	if len(config.Global.LDAP_ConnectTimeout) > 0 {
+		if t, err := time.ParseDuration(config.Global.LDAP_ConnectTimeout); err == nil {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// parseLDAPServer returns the scheme and the host:port of an LDAP server,
+// given either as an ldap:// or ldaps:// URL or as a plain host:port.
+func parseLDAPServer(server string) (string, string, error) {
+	if !strings.Contains(server, "://") {
+		return "ldap", server, nil
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", "", err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ldap":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, ldap.DefaultLdapPort)
+		}
+	case "ldaps":
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = net.JoinHostPort(host, ldap.DefaultLdapsPort)
+		}
+	default:
+		return "", "", fmt.Errorf("Unknown scheme '%s'", u.Scheme)
+	}
+	return u.Scheme, host, nil
+}
+
+func ldapTLSConfig(config *SSHConfig, host string) (*tls.Config, error) {
+	serverName, _, err := net.SplitHostPort(host)
+	if err != nil {
+		serverName = host
+	}
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if len(config.Global.LDAP_CAFile) > 0 {
+		pem, err := ioutil.ReadFile(config.Global.LDAP_CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read LDAP CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificate found in LDAP CA file %s", config.Global.LDAP_CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func dialLDAPServer(config *SSHConfig, server string) (*ldap.Conn, error) {
+	scheme, host, err := parseLDAPServer(server)
+	if err != nil {
+		return nil, err
+	}
+	timeout := ldapTimeout(config)
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var l *ldap.Conn
+	if scheme == "ldaps" {
+		tlsConfig, err := ldapTLSConfig(config, host)
+		if err != nil {
+			return nil, err
+		}
+		c, err := tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		l = ldap.NewConn(c, true)
+	} else {
+		c, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return nil, err
+		}
+		l = ldap.NewConn(c, false)
+	}
+	l.Start()
+	l.SetTimeout(timeout)
+
+	if scheme == "ldap" && config.Global.LDAP_StartTLS {
+		tlsConfig, err := ldapTLSConfig(config, host)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if err := l.StartTLS(tlsConfig); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("StartTLS failed: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// dial connects to the first reachable LDAP server, in the configured order.
+func (c *ldapClient) dial(config *SSHConfig) (*ldap.Conn, error) {
+	servers := ldapServers(config)
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("No LDAP server configured")
+	}
+
+	var err error
+	for _, server := range servers {
+		var l *ldap.Conn
+		l, err = dialLDAPServer(config, server)
+		if err == nil {
+			return l, nil
+		}
+		log.Printf("LDAP Connect Failed (%s): %s", server, err)
+	}
+	return nil, err
+}
+
+func ldapSettings(config *SSHConfig) string {
+	g := config.Global
+	return fmt.Sprintf("%v|%t|%s|%s", ldapServers(config), g.LDAP_StartTLS, g.LDAP_CAFile, g.LDAP_ConnectTimeout)
+}
+
+func (c *ldapClient) get(config *SSHConfig) (*ldap.Conn, error) {
+	c.lock.Lock()
+	if settings := ldapSettings(config); settings != c.settings {
+		for _, l := range c.idle {
+			l.Close()
+		}
+		c.idle = nil
+		c.settings = settings
+	}
+	for len(c.idle) > 0 {
+		l := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		if !l.IsClosing() {
+			c.lock.Unlock()
+			return l, nil
+		}
+	}
+	c.lock.Unlock()
+
+	return c.dial(config)
+}
+
+func (c *ldapClient) put(config *SSHConfig, l *ldap.Conn) {
+	size := config.Global.LDAP_PoolSize
+	if size == 0 {
+		size = 4
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ldapSettings(config) != c.settings || len(c.idle) >= size || l.IsClosing() {
+		l.Close()
+		return
+	}
+	c.idle = append(c.idle, l)
+}
+
+// withConn runs f on a pooled connection. If the connection turns out to be
+// broken, f is run again once on a new connection.
+func (c *ldapClient) withConn(config *SSHConfig, f func(l *ldap.Conn) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var l *ldap.Conn
+		l, err = c.get(config)
+		if err != nil {
+			return err
+		}
+
+		err = f(l)
+		if err != nil && ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			l.Close()
+			continue
+		}
+		c.put(config, l)
+		return err
+	}
+	return err
+}
+
+// ldapUserDN returns the DN to bind as user. In search mode (ldap_bind_dn
+// set), the service account looks the user up with ldap_user_filter,
+// otherwise the AD form <user>@ldap_domain is used.
+func ldapUserDN(config *SSHConfig, l *ldap.Conn, user string) (string, error) {
+	if len(config.Global.LDAP_BindDN) == 0 {
+		return fmt.Sprintf("%s@%s", user, config.Global.LDAP_Domain), nil
+	}
+
+	entry, err := ldapSearchUser(config, l, user, []string{"dn"})
+	if err != nil {
+		return "", err
+	}
+	return entry.DN, nil
+}
+
+// ldapSearchUser binds as the service account and returns the entry of user.
+func ldapSearchUser(config *SSHConfig, l *ldap.Conn, user string, attributes []string) (*ldap.Entry, error) {
+	if err := l.Bind(config.Global.LDAP_BindDN, config.Global.LDAP_BindPassword); err != nil {
+		log.Printf("LDAP service account Bind Failed: %s", err)
+		return nil, fmt.Errorf("LDAP service account Bind Failed: %s", err)
+	}
+
+	return ldapSearchEntry(config, l, user, attributes)
+}
+
+// ldapSearchEntry returns the entry of user found with ldap_user_filter, with
+// the current bind. The default filter is (uid={username}) in search mode,
+// and (sAMAccountName={username}) for AD.
+func ldapSearchEntry(config *SSHConfig, l *ldap.Conn, user string, attributes []string) (*ldap.Entry, error) {
+	filter := config.Global.LDAP_UserFilter
+	if len(filter) == 0 {
+		if len(config.Global.LDAP_BindDN) > 0 {
+			filter = "(uid={username})"
+		} else {
+			filter = "(sAMAccountName={username})"
+		}
+	}
+	filter = strings.Replace(filter, "{username}", ldap.EscapeFilter(user), -1)
+
+	req := ldap.NewSearchRequest(config.Global.LDAP_BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(ldapTimeout(config)/time.Second), false, filter, attributes, nil)
+	res, err := l.Search(req)
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("LDAP Search Failed: %s", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, fmt.Errorf("LDAP Search Failed: user not found or not unique")
+	}
+	return res.Entries[0], nil
+}
+
+// ldapParentGroups returns the DNs of the groups dn is a direct member of,
+// either from its memberOf attribute or, when ldap_group_filter is set, by
+// searching the groups.
+func ldapParentGroups(config *SSHConfig, l *ldap.Conn, dn string) ([]string, error) {
+	timeLimit := int(ldapTimeout(config) / time.Second)
+
+	if len(config.Global.LDAP_GroupFilter) == 0 {
+		req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			0, timeLimit, false, "(objectClass=*)", []string{"memberOf"}, nil)
+		res, err := l.Search(req)
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Entries) == 0 {
+			return nil, nil
+		}
+		return res.Entries[0].GetAttributeValues("memberOf"), nil
+	}
+
+	base := config.Global.LDAP_GroupBaseDN
+	if len(base) == 0 {
+		base = config.Global.LDAP_BaseDN
+	}
+	filter := strings.Replace(config.Global.LDAP_GroupFilter, "{dn}", ldap.EscapeFilter(dn), -1)
+	req := ldap.NewSearchRequest(base, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, timeLimit, false, filter, []string{"dn"}, nil)
+	res, err := l.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	groups := []string{}
+	for _, e := range res.Entries {
+		groups = append(groups, e.DN)
+	}
+	return groups, nil
+}
+
+// ldapUserGroups returns the DNs of all the groups of the user entry, nested
+// groups included when ldap_nested_groups is set.
+func ldapUserGroups(config *SSHConfig, l *ldap.Conn, dn string) ([]string, error) {
+	const maxDepth = 10
+
+	seen := make(map[string]bool)
+	groups := []string{}
+	current := []string{dn}
+	for depth := 0; depth < maxDepth && len(current) > 0; depth++ {
+		next := []string{}
+		for _, d := range current {
+			parents, err := ldapParentGroups(config, l, d)
+			if err != nil {
+				return nil, fmt.Errorf("LDAP group lookup failed for %s: %s", d, err)
+			}
+			for _, p := range parents {
+				key := strings.ToLower(p)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				groups = append(groups, p)
+				next = append(next, p)
+			}
+		}
+		if !config.Global.LDAP_NestedGroups {
+			break
+		}
+		current = next
+	}
+	return groups, nil
+}
+
+// ldapGroupACLs returns the ACLs granted to user by its LDAP groups, as
+// configured in ldap_group_acls. A mapping key matches either the full DN of
+// a group or its CN.
+func ldapGroupACLs(config *SSHConfig, l *ldap.Conn, user string) ([]string, error) {
+	var entry *ldap.Entry
+	var err error
+	if len(config.Global.LDAP_BindDN) > 0 {
+		entry, err = ldapSearchUser(config, l, user, []string{"dn"})
+	} else {
+		entry, err = ldapSearchEntry(config, l, user, []string{"dn"})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := ldapUserGroups(config, l, entry.DN)
+	if err != nil {
+		return nil, err
+	}
+
+	acls := []string{}
+	granted := make(map[string]bool)
+	for _, g := range groups {
+		cn := ""
+		if parsed, err := ldap.ParseDN(g); err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+			cn = parsed.RDNs[0].Attributes[0].Value
+		}
+		for key, acl := range config.Global.LDAP_GroupACLs {
+			if (strings.EqualFold(key, g) || strings.EqualFold(key, cn)) && !granted[acl] {
+				granted[acl] = true
+				acls = append(acls, acl)
+			}
+		}
+	}
+	return acls, nil
+}
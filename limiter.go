@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The limiter counts the failed password, keyboard-interactive and TOTP
+// attempts per source IP and per user name. After each failure the next
+// attempt is refused, without reaching the backends, during a back-off which
+// doubles with each failure. After ban_max_failures failures the IP or user
+// is banned for ban_time: banned IPs are disconnected before the handshake,
+// banned users can't log in with a password anymore.
+
+const (
+	defaultBanMaxFailures = 5
+	defaultBanTime        = 15 * time.Minute
+	maxAuthBackoff        = time.Minute
+)
+
+var errThrottled = errors.New("Too many authentication failures, retry later")
+
+type failureEntry struct {
+	failures    int
+	last        time.Time
+	bannedUntil time.Time
+}
+
+type authLimiter struct {
+	lock    sync.Mutex
+	entries map[string]*failureEntry
+}
+
+var limiter = &authLimiter{entries: map[string]*failureEntry{}}
+
+func limiterIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func banMaxFailures(config *SSHConfig) int {
+	if config.Global.BanMaxFailures == 0 {
+		return defaultBanMaxFailures
+	}
+	return config.Global.BanMaxFailures
+}
+
+func banTime(config *SSHConfig) time.Duration {
+	if d, err := time.ParseDuration(config.Global.BanTime); err == nil && d > 0 {
+		return d
+	}
+	return defaultBanTime
+}
+
+// banIgnored tells if ip is listed in ban_ignore_ips.
+func banIgnored(config *SSHConfig, ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, cidr := range config.Global.BanIgnoreIPs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			if parsed != nil && network.Contains(parsed) {
+				return true
+			}
+		} else if cidr == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *authLimiter) keys(config *SSHConfig, ip string, user string) []string {
+	keys := []string{"user " + user}
+	if !banIgnored(config, ip) {
+		keys = append(keys, "ip "+ip)
+	}
+	return keys
+}
+
+// Banned tells if connections from ip have to be dropped.
+func (l *authLimiter) Banned(config *SSHConfig, ip string) bool {
+	if banMaxFailures(config) < 0 || banIgnored(config, ip) {
+		return false
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	e, ok := l.entries["ip "+ip]
+	return ok && time.Now().Before(e.bannedUntil)
+}
+
+// Allowed returns errThrottled if ip or user is banned or in back-off.
+func (l *authLimiter) Allowed(config *SSHConfig, ip string, user string) error {
+	if banMaxFailures(config) < 0 {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range l.keys(config, ip, user) {
+		e, ok := l.entries[key]
+		if !ok {
+			continue
+		}
+		if now.Before(e.bannedUntil) {
+			return errThrottled
+		}
+		if e.failures > 0 && now.Before(e.last.Add(authBackoff(e.failures))) {
+			return errThrottled
+		}
+	}
+	return nil
+}
+
+func authBackoff(failures int) time.Duration {
+	d := time.Second
+	for i := 1; i < failures && d < maxAuthBackoff; i++ {
+		d *= 2
+	}
+	if d > maxAuthBackoff {
+		d = maxAuthBackoff
+	}
+	return d
+}
+
+// Failure records a failed attempt, and bans ip or user when they reach
+// ban_max_failures.
+func (l *authLimiter) Failure(config *SSHConfig, ip string, user string) {
+	max := banMaxFailures(config)
+	if max < 0 {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	for _, key := range l.keys(config, ip, user) {
+		e, ok := l.entries[key]
+		if !ok {
+			e = &failureEntry{}
+			l.entries[key] = e
+		}
+		if now.Before(e.bannedUntil) {
+			continue
+		}
+		e.failures++
+		e.last = now
+		if e.failures >= max {
+			e.bannedUntil = now.Add(banTime(config))
+			WriteAuthLog("Banned %s for %s after %d authentication failures.", key, banTime(config), e.failures)
+		}
+	}
+}
+
+// Success forgets the failures of user. The ones of the IP are kept, so an
+// attacker owning an account can't use it to reset its counter.
+func (l *authLimiter) Success(user string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if e, ok := l.entries["user "+user]; ok && e.bannedUntil.IsZero() {
+		delete(l.entries, "user "+user)
+	}
+}
+
+// Unban lifts the bans and failures of an IP or a user name, or of everybody
+// with "all". It returns the keys removed.
+func (l *authLimiter) Unban(name string) []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	removed := []string{}
+	for key, e := range l.entries {
+		if name == "all" || key == "ip "+name || key == "user "+name {
+			delete(l.entries, key)
+			if !e.bannedUntil.IsZero() {
+				WriteAuthLog("Unbanned %s by administrator.", key)
+			}
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// Expire lifts the bans which ended, and forgets the failures older than
+// ban_time. It runs until the daemon stops.
+func (l *authLimiter) Expire() {
+	for range time.Tick(time.Minute) {
+		config := currentConfig()
+		now := time.Now()
+
+		l.lock.Lock()
+		for key, e := range l.entries {
+			if !e.bannedUntil.IsZero() {
+				if now.After(e.bannedUntil) {
+					delete(l.entries, key)
+					WriteAuthLog("Ban of %s expired.", key)
+				}
+			} else if now.After(e.last.Add(banTime(config))) {
+				delete(l.entries, key)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+// Status lists the tracked IPs and users, bans first.
+func (l *authLimiter) Status() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	bans, failures := []string{}, []string{}
+	for key, e := range l.entries {
+		if now.Before(e.bannedUntil) {
+			bans = append(bans, fmt.Sprintf("%s banned until %s (%d failures)", key, e.bannedUntil.Format(time.RFC3339), e.failures))
+		} else if e.bannedUntil.IsZero() {
+			failures = append(failures, fmt.Sprintf("%s %d failures, last at %s", key, e.failures, e.last.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(bans)
+	sort.Strings(failures)
+	return append(bans, failures...)
+}
+
+// countsAsFailure tells if a failed authentication method is counted by the
+// limiter. Public keys are offered one by one by the clients and don't reach
+// any external backend, so their failures are not counted.
+func countsAsFailure(method string, err error) bool {
+	if err == nil || err == errThrottled {
+		return false
+	}
+	switch strings.ToLower(method) {
+	case "password", "keyboard-interactive", "totp":
+		return true
+	}
+	return false
+}
@@ -28,8 +28,10 @@ type LogChannel struct {
 	UserName      string
 	RemoteIP      string
 	AuthType      string
+	ChannelID     int
 	ActualChannel ssh.Channel
 	FluentBit     string
+	Config        *SSHConfig
 	fd            *os.File
 	fd_ttyrec     *os.File
 	fd_req        *os.File
@@ -49,7 +51,7 @@ func writeTTYRecHeader(fd io.Writer, length int) {
 	binary.Write(fd, binary.LittleEndian, int32(length))
 }
 
-func NewLogChannel(startTime time.Time, channel ssh.Channel, username string, remote_ip string, auth_type string) *LogChannel {
+func NewLogChannel(config *SSHConfig, startTime time.Time, channel ssh.Channel, username string, remote_ip string, auth_type string) *LogChannel {
 	l := LogChannel{
 		StartTime:     startTime,
 		UserName:      username,
@@ -61,6 +63,7 @@ func NewLogChannel(startTime time.Time, channel ssh.Channel, username string, re
 		reqBuffer:     bytes.NewBuffer([]byte{}),
 		logMutex:      &sync.Mutex{},
 		FluentBit:     config.Global.FluentbitServer,
+		Config:        config,
 	}
 
 	if l.FluentBit != "" {
@@ -94,12 +97,16 @@ func (l *LogChannel) Log_fluentbit(logger string, data string) error {
 func (l *LogChannel) RelayStart(remote_name string) error {
 	var err error
 
-	filepath := fmt.Sprintf("%s/%d/%d", config.Global.LogPath, l.StartTime.Year(), l.StartTime.Month())
+	filepath := fmt.Sprintf("%s/%d/%d", l.Config.Global.LogPath, l.StartTime.Year(), l.StartTime.Month())
 	err = os.MkdirAll(filepath, 0750)
 	if err != nil {
 		return fmt.Errorf("Unable to create required log directory (%s): %s", filepath, err)
 	}
 	filename := filepath + "/" + fmt.Sprintf("ssh_log_%s_%s_%s", l.StartTime.Format(time.RFC3339), l.UserName, remote_name)
+	if l.ChannelID > 0 {
+		// Later sessions of a multiplexed connection
+		filename += fmt.Sprintf("_%d", l.ChannelID)
+	}
 
 	l.logMutex.Lock()
 
@@ -167,13 +174,40 @@ func (l *LogChannel) Read(data []byte) (int, error) {
 }
 
 func (l *LogChannel) Write(data []byte) (int, error) {
+	if err := l.record(data); err != nil {
+		return 0, err
+	}
+	return l.ActualChannel.Write(data)
+}
+
+// Stderr returns a writer on the extended data stream of the channel, recorded
+// like the standard output.
+func (l *LogChannel) Stderr() io.Writer {
+	return logStderr{l}
+}
+
+type logStderr struct {
+	l *LogChannel
+}
+
+func (w logStderr) Write(data []byte) (int, error) {
+	if err := w.l.record(data); err != nil {
+		return 0, err
+	}
+	return w.l.ActualChannel.Stderr().Write(data)
+}
+
+// record writes data sent to the client in the session log and the ttyrec
+// file.
+func (l *LogChannel) record(data []byte) error {
 	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
 	if len(data) > 0 {
 
 		if l.FluentBit != "" {
 			err := l.Log_fluentbit("session", bytes.NewBuffer(data).String())
 			if err != nil {
-				return 0, err
+				return err
 			}
 		} else {
 			if l.fd != nil {
@@ -191,9 +225,7 @@ func (l *LogChannel) Write(data []byte) (int, error) {
 			l.ttyrecBuffer.Write(data)
 		}
 	}
-	l.logMutex.Unlock()
-
-	return l.ActualChannel.Write(data)
+	return nil
 }
 
 func (l *LogChannel) Close() error {
@@ -249,3 +281,34 @@ func (l *LogChannel) LogRequest(r *ssh.Request) {
 func (l *LogChannel) SendRequest(name string, wantReply bool, payload []byte) (bool, error) {
 	return l.ActualChannel.SendRequest(name, wantReply, payload)
 }
+
+// LogEvent records an event of the relay, such as an executed command, in the
+// session log and the .sshreq file. fields are name/value pairs.
+func (l *LogChannel) LogEvent(event string, fields ...string) {
+	l.logMutex.Lock()
+	defer l.logMutex.Unlock()
+
+	now := time.Now()
+	record := fmt.Sprintf("\n[LOGGER] Timestamp: %s\n[LOGGER] Event: %s\n", now, event)
+	reqLine := fmt.Sprintf("%s: Event - %s", now.Format(time.RFC3339), event)
+	for i := 0; i+1 < len(fields); i += 2 {
+		record += fmt.Sprintf("[LOGGER] %s: %s\n", fields[i], fields[i+1])
+		reqLine += fmt.Sprintf(" - %s: %q", fields[i], fields[i+1])
+	}
+
+	if l.FluentBit != "" {
+		l.Log_fluentbit("event", reqLine)
+		return
+	}
+
+	if l.fd != nil {
+		l.fd.Write([]byte(record + "\n"))
+	} else {
+		l.initialBuffer.Write([]byte(record + "\n"))
+	}
+	if l.fd_req != nil {
+		l.fd_req.Write([]byte(reqLine + "\r\n"))
+	} else {
+		l.reqBuffer.Write([]byte(reqLine + "\r\n"))
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"github.com/jessevdk/go-flags"
 )
 
-var config *SSHConfig
 var authLogger *syslog.Writer
 
 var opts struct {
@@ -20,30 +19,57 @@ var opts struct {
 
 func main() {
 
-    _, err := flags.Parse(&opts)
+    parser := flags.NewParser(&opts, flags.Default)
+    parser.SubcommandsOptional = true
+    parser.AddCommand("admin", "Send a command to the running daemon",
+        "Send a command to the running daemon through its admin socket (see admin_socket).", &adminCommand{})
+    parser.AddCommand("check-config", "Check the configuration",
+        "Load the configuration and every group file the way the daemon does, and report all errors and warnings. "+
+        "Exits with a non-zero status if an error is found.", &checkConfigCommand{})
+    parser.AddCommand("keyscan", "Scan the host keys of the servers",
+        "Connect to the servers, or to the ones of a group or given as arguments, collect their host keys and show the "+
+        "differences with their host_pubkeys. Once approved, the keys are written in the file declaring each server.", &keyscanCommand{})
+    parser.AddCommand("passwd", "Set the password of a user in the password file",
+        "Create or update the entry of a user in the password file used by the file auth backend (see password_file). "+
+        "The password is read from the terminal, or from the standard input.", &passwdCommand{})
+
+    _, err := parser.Parse()
     if err != nil {
         os.Exit(1)
     }
+    if parser.Active != nil {
+        return
+    }
 
     if _, err := os.Stat(opts.Config); err != nil {
         log.Fatalf("Specified config file doesn't exist!\n")
     }
 
-    config, err = fetchConfig(opts.Config)
+    config, err := fetchConfig(opts.Config)
     if err != nil {
         panic(err)
     }
+    setConfig(config)
 
     authLogger, err = syslog.New(syslog.LOG_AUTH | syslog.LOG_ALERT, "ssh-bastion")
     if err != nil {
         panic(err)
     }
 
-    s, err := NewSSHServer()
+    s, err := NewSSHServer(config)
     if err != nil {
         panic(err)
     }
 
+    go s.WatchReloadSignal(opts.Config)
+    go limiter.Expire()
+    if len(config.Global.AdminSocket) > 0 {
+        err = s.ListenAdmin(config.Global.AdminSocket, opts.Config)
+        if err != nil {
+            panic(err)
+        }
+    }
+
     bind_protocol := "tcp"
     if (config.Global.NoIP6Bind == true) {
         bind_protocol = "tcp4"
@@ -52,7 +78,7 @@ func main() {
     
 }
 
-func GetMOTD() (string) {
+func GetMOTD(config *SSHConfig) (string) {
     if len(config.Global.MOTDPath) > 0 {
         str, err := ioutil.ReadFile(config.Global.MOTDPath)
         if err != nil {
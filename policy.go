@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A request_policy, set on ACLs and servers, controls the requests of the
+// sessions relayed to the targets. Each request type (or "default" for the
+// types not listed) is allowed, denied or rewritten, the env requests can be
+// limited to a list of variables and the subsystem ones to a list of
+// subsystems. The shell and exec requests are not concerned, they are
+// controlled by the ACLs.
+
+const (
+	requestAllow   = "allow"
+	requestDeny    = "deny"
+	requestRewrite = "rewrite"
+)
+
+// Request types a policy can be given for, and the ones that can be
+// rewritten.
+var (
+	policyRequestTypes  = []string{"default", "pty-req", "x11-req", "env", "window-change", "signal", "break", "subsystem"}
+	policyRewriteTypes  = []string{"pty-req", "signal"}
+	policyExemptRequest = []string{"shell", "exec"}
+)
+
+type SSHConfigRequestPolicy struct {
+	Requests   map[string]string `yaml:"requests"`
+	Rewrite    map[string]string `yaml:"rewrite"`
+	Env        []string          `yaml:"env"`
+	Subsystems []string          `yaml:"subsystems"`
+}
+
+type envRequestPayload struct {
+	Name  string
+	Value string
+}
+
+type ptyRequestPayload struct {
+	Term    string
+	Columns uint32
+	Rows    uint32
+	Width   uint32
+	Height  uint32
+	Modes   string
+}
+
+// action returns the action of the policy for a request type.
+func (p *SSHConfigRequestPolicy) action(reqType string) string {
+	if a, ok := p.Requests[reqType]; ok {
+		return a
+	}
+	if a, ok := p.Requests["default"]; ok {
+		return a
+	}
+	return requestAllow
+}
+
+// Check applies the policy to a request, and returns the payload to send to
+// the target or the reason of the refusal. A nil policy allows everything.
+func (p *SSHConfigRequestPolicy) Check(reqType string, payload []byte) ([]byte, error) {
+	if p == nil || contains(policyExemptRequest, reqType) {
+		return payload, nil
+	}
+	action := p.action(reqType)
+	if action == requestDeny {
+		return nil, fmt.Errorf("%s requests are denied", reqType)
+	}
+
+	switch reqType {
+	case "env":
+		if len(p.Env) == 0 {
+			break
+		}
+		var env envRequestPayload
+		if err := ssh.Unmarshal(payload, &env); err != nil {
+			return nil, fmt.Errorf("invalid env request")
+		}
+		value, ok := matchEnv(p.Env, env.Name)
+		if !ok {
+			return nil, fmt.Errorf("variable %s is not in the env allowlist", env.Name)
+		}
+		if value != nil {
+			env.Value = *value
+			payload = ssh.Marshal(env)
+		}
+	case "subsystem":
+		if len(p.Subsystems) == 0 {
+			break
+		}
+		var subsystem struct{ Name string }
+		if err := ssh.Unmarshal(payload, &subsystem); err != nil {
+			return nil, fmt.Errorf("invalid subsystem request")
+		}
+		if !contains(p.Subsystems, subsystem.Name) {
+			return nil, fmt.Errorf("subsystem %s is not allowed", subsystem.Name)
+		}
+	}
+
+	if action != requestRewrite {
+		return payload, nil
+	}
+	value := p.Rewrite[reqType]
+	switch reqType {
+	case "pty-req":
+		var pty ptyRequestPayload
+		if err := ssh.Unmarshal(payload, &pty); err != nil {
+			return nil, fmt.Errorf("invalid pty-req request")
+		}
+		pty.Term = value
+		payload = ssh.Marshal(pty)
+	case "signal":
+		payload = ssh.Marshal(struct{ Signal string }{value})
+	}
+	return payload, nil
+}
+
+// matchEnv looks a variable up in an env allowlist. Entries are names or
+// patterns, "NAME=value" ones force the value of the variable.
+func matchEnv(allowed []string, name string) (*string, bool) {
+	for _, entry := range allowed {
+		pattern, value, forced := cutString(entry, "=")
+		if matched, err := path.Match(pattern, name); err != nil || !matched {
+			continue
+		}
+		if forced {
+			return &value, true
+		}
+		return nil, true
+	}
+	return nil, false
+}
+
+func cutString(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// mergeRequestPolicies merges the policies of two ACLs, the most permissive
+// action wins for each request type. A nil policy allows everything.
+func mergeRequestPolicies(a, b *SSHConfigRequestPolicy) *SSHConfigRequestPolicy {
+	if a == nil || b == nil {
+		return nil
+	}
+	rank := map[string]int{requestDeny: 0, requestRewrite: 1, requestAllow: 2}
+	merged := &SSHConfigRequestPolicy{Requests: map[string]string{}, Rewrite: map[string]string{}}
+	for _, p := range []*SSHConfigRequestPolicy{a, b} {
+		for t := range p.Requests {
+			merged.Requests[t] = ""
+		}
+		for t, v := range p.Rewrite {
+			if _, ok := merged.Rewrite[t]; !ok {
+				merged.Rewrite[t] = v
+			}
+		}
+	}
+	merged.Requests["default"] = ""
+	for t := range merged.Requests {
+		action := a.action(t)
+		if other := b.action(t); rank[other] > rank[action] {
+			action = other
+		}
+		merged.Requests[t] = action
+	}
+
+	// A policy allowing the requests without a list allows them all.
+	mergeList := func(reqType string, la, lb []string) []string {
+		if (a.action(reqType) != requestDeny && len(la) == 0) || (b.action(reqType) != requestDeny && len(lb) == 0) {
+			return nil
+		}
+		list := []string{}
+		if a.action(reqType) != requestDeny {
+			list = appendUnique(list, la...)
+		}
+		if b.action(reqType) != requestDeny {
+			list = appendUnique(list, lb...)
+		}
+		return list
+	}
+	merged.Env = mergeList("env", a.Env, b.Env)
+	merged.Subsystems = mergeList("subsystem", a.Subsystems, b.Subsystems)
+	return merged
+}
+
+// filterRequests passes on the requests of reqs until done is closed, after
+// applying the policies to them: the denied requests are refused and
+// recorded with the reason. The x11-req requests are refused unless
+// allowX11. The requests already received are passed on before it returns,
+// to be sent before the command of exec sessions.
+func filterRequests(conn *BastionConn, channel *LogChannel, reqs <-chan *ssh.Request, done <-chan struct{}, remote_name string, allowX11 bool, policies ...*SSHConfigRequestPolicy) <-chan *ssh.Request {
+	out := make(chan *ssh.Request, cap(reqs))
+	deny := func(req *ssh.Request, reason string) {
+		channel.LogEvent("Request denied", "Type", req.Type, "Reason", reason)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+	filter := func(req *ssh.Request) {
+		if req.Type == "x11-req" && !allowX11 {
+			WriteAuthLog("Refused X11 forwarding on %s by %s from %s.", remote_name, conn.User(), conn.RemoteAddr())
+			deny(req, "X11 forwarding is not allowed")
+			return
+		}
+		payload := req.Payload
+		for _, p := range policies {
+			var err error
+			if payload, err = p.Check(req.Type, payload); err != nil {
+				deny(req, err.Error())
+				return
+			}
+		}
+		if string(payload) != string(req.Payload) {
+			channel.LogEvent("Request rewritten", "Type", req.Type, "Payload", fmt.Sprintf("%#v", payload))
+			req.Payload = payload
+		}
+		out <- req
+	}
+pending:
+	for {
+		select {
+		case req := <-reqs:
+			filter(req)
+		default:
+			break pending
+		}
+	}
+	go func() {
+		for {
+			select {
+			case req := <-reqs:
+				filter(req)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// checkRequestPolicy validates the request_policy of an ACL or a server.
+func checkRequestPolicy(diags *ConfigDiagnostics, file string, base string, p *SSHConfigRequestPolicy) {
+	if p == nil {
+		return
+	}
+	for t, action := range p.Requests {
+		key := base + ".requests." + t
+		if !contains(policyRequestTypes, t) {
+			diags.Errorf(file, key, "Unsupported request type %q", t)
+			continue
+		}
+		switch action {
+		case requestAllow, requestDeny:
+		case requestRewrite:
+			if !contains(policyRewriteTypes, t) {
+				diags.Errorf(file, key, "Requests of type %q can't be rewritten", t)
+			} else if _, ok := p.Rewrite[t]; !ok {
+				diags.Errorf(file, key, "No rewrite value defined")
+			}
+		default:
+			diags.Errorf(file, key, "Invalid action %q (expected %s, %s or %s)", action, requestAllow, requestDeny, requestRewrite)
+		}
+	}
+	for t := range p.Rewrite {
+		if p.Requests[t] != requestRewrite {
+			diags.Warnf(file, base+".rewrite."+t, "Ignored, the action of %s is not %s", t, requestRewrite)
+		}
+	}
+	for i, e := range p.Env {
+		pattern, _, _ := cutString(e, "=")
+		if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+			diags.Errorf(file, fmt.Sprintf("%s.env[%d]", base, i), "Invalid variable pattern %q", e)
+		}
+	}
+}
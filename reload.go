@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ReloadConfig reads the configuration file again and swaps it in place of
+// the current one. Sessions already started keep the configuration they were
+// started with. If the new configuration is invalid, the current one is kept.
+func (s *SSHServer) ReloadConfig(filename string) error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	config, err := fetchConfig(filename)
+	if err != nil {
+		log.Printf("Configuration reload rejected, keeping previous configuration: %v", err)
+		WriteAuthLog("Configuration reload from %s rejected: %v.", filename, err)
+		return err
+	}
+
+	sshConfig, err := newServerConfig(config)
+	if err != nil {
+		log.Printf("Configuration reload rejected, keeping previous configuration: %v", err)
+		WriteAuthLog("Configuration reload from %s rejected: %v.", filename, err)
+		return err
+	}
+
+	if previous := currentConfig(); previous != nil {
+		if (previous.Global.ListenPath != config.Global.ListenPath) || (previous.Global.NoIP6Bind != config.Global.NoIP6Bind) {
+			log.Printf("Listener settings changed, a restart is required to apply them")
+		}
+		if previous.Global.AdminSocket != config.Global.AdminSocket {
+			log.Printf("Admin socket changed, a restart is required to apply it")
+		}
+	}
+
+	s.lock.Lock()
+	s.sshConfig = sshConfig
+	setConfig(config)
+	s.lock.Unlock()
+
+	log.Printf("Configuration reloaded from %s", filename)
+	WriteAuthLog("Configuration reloaded from %s.", filename)
+	return nil
+}
+
+// WatchReloadSignal reloads the configuration each time SIGHUP is received.
+func (s *SSHServer) WatchReloadSignal(filename string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		log.Printf("SIGHUP received, reloading configuration")
+		s.ReloadConfig(filename)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With scp_relay in one of their ACLs, users logging in as "user+target" can
+// run scp with the target as remote host. The bastion starts the same scp
+// command on the target and follows the protocol between both ends, recording
+// and hashing each file, and copying it to capture_path with scp_capture.
+
+// Characters which would let the remote shell run something else than scp.
+const scpForbiddenChars = ";&|`$()<>\r\n"
+
+// scpTransfer is an scp command run by a client in source (-f, download) or
+// sink (-t, upload) mode.
+type scpTransfer struct {
+	Command string
+	Upload  bool
+	Paths   string
+
+	channel *LogChannel
+	remote  string
+	capture string
+	files   int
+}
+
+// parseSCPCommand recognizes the commands run by the scp clients on the remote
+// side: "scp [-dprv] -t|-f [--] path...". It returns nil for other commands.
+func parseSCPCommand(command string) (*scpTransfer, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 || fields[0] != "scp" {
+		return nil, nil
+	}
+
+	t := &scpTransfer{Command: strings.TrimSpace(command)}
+	sink, source := false, false
+	i := 1
+	for ; i < len(fields) && strings.HasPrefix(fields[i], "-"); i++ {
+		if fields[i] == "--" {
+			i++
+			break
+		}
+		for _, c := range fields[i][1:] {
+			switch c {
+			case 't':
+				sink = true
+			case 'f':
+				source = true
+			case 'd', 'p', 'r', 'v', 'q':
+			default:
+				if sink || source {
+					return nil, fmt.Errorf("Unsupported scp option -%c", c)
+				}
+				return nil, nil
+			}
+		}
+	}
+	if !sink && !source {
+		return nil, nil
+	}
+	if sink && source {
+		return nil, fmt.Errorf("Invalid scp command")
+	}
+	if i >= len(fields) {
+		return nil, fmt.Errorf("Missing scp path")
+	}
+	if strings.ContainsAny(t.Command, scpForbiddenChars) {
+		return nil, fmt.Errorf("Invalid characters in scp command")
+	}
+
+	t.Upload = sink
+	t.Paths = strings.Join(fields[i:], " ")
+	return t, nil
+}
+
+// Direction names the transfer from the point of view of the client.
+func (t *scpTransfer) Direction() string {
+	if t.Upload {
+		return "upload"
+	}
+	return "download"
+}
+
+// Relay follows the protocol between the client and the scp command of the
+// target. Everything read from one end is forwarded as is to the other one,
+// the files are recorded as they pass through.
+func (t *scpTransfer) Relay(client io.ReadWriter, stdin io.Writer, stdout io.Reader) error {
+	// The source sends the messages and the content of the files, the sink
+	// answers each of them with a status.
+	var src, sink *bufio.Reader
+	if t.Upload {
+		src = bufio.NewReader(io.TeeReader(client, stdin))
+		sink = bufio.NewReader(io.TeeReader(stdout, client))
+	} else {
+		src = bufio.NewReader(io.TeeReader(stdout, client))
+		sink = bufio.NewReader(io.TeeReader(client, stdin))
+	}
+
+	err := t.follow(src, sink)
+	if err != nil {
+		t.channel.LogEvent("SCP transfer not recorded", "Error", err.Error())
+		// Keep relaying until the target is done.
+		fromClient, fromTarget := sink, src
+		if t.Upload {
+			fromClient, fromTarget = src, sink
+		}
+		go io.Copy(ioutil.Discard, fromClient)
+		io.Copy(ioutil.Discard, fromTarget)
+	}
+	return err
+}
+
+func (t *scpTransfer) follow(src *bufio.Reader, sink *bufio.Reader) error {
+	dirs := []string{}
+	if _, err := t.sinkStatus(sink, "Paths", t.Paths); err != nil {
+		return err
+	}
+
+	for {
+		line, err := src.ReadString('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		switch line[0] {
+		case '\x01', '\x02':
+			// Error of the source, not acknowledged.
+			t.channel.LogEvent("SCP error", "Message", strings.TrimSpace(line[1:]))
+			continue
+		case 'T':
+		case 'E':
+			if len(dirs) > 0 {
+				dirs = dirs[:len(dirs)-1]
+			}
+		case 'D', 'C':
+			mode, size, name, err := parseSCPHeader(line)
+			if err != nil {
+				return err
+			}
+			filename := path.Join(append(dirs, name)...)
+			if ok, err := t.sinkStatus(sink, "Direction", t.Direction(), "Path", filename); err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			if line[0] == 'D' {
+				dirs = append(dirs, name)
+			} else if err := t.file(src, sink, filename, mode, size); err != nil {
+				return err
+			}
+			continue
+		default:
+			return fmt.Errorf("unexpected scp message (%x)", line[0])
+		}
+
+		if _, err := t.sinkStatus(sink, "Direction", t.Direction(), "Message", strings.TrimSpace(line)); err != nil {
+			return err
+		}
+	}
+}
+
+// sinkStatus reads the answer of the sink to a message, and records it when
+// it is a refusal. An error is returned when the sink is gone.
+func (t *scpTransfer) sinkStatus(sink *bufio.Reader, fields ...string) (bool, error) {
+	err := checkSCPStatus(sink)
+	if err == nil {
+		return true, nil
+	}
+	if err == io.EOF {
+		return false, err
+	}
+	t.channel.LogEvent("SCP refused", append(fields, "Error", err.Error())...)
+	return false, nil
+}
+
+// file records the content of a file and the statuses which follow it.
+func (t *scpTransfer) file(src *bufio.Reader, sink *bufio.Reader, filename string, mode string, size int64) error {
+	t.files++
+	hash := sha256.New()
+	var w io.Writer = hash
+
+	captured := ""
+	if len(t.capture) > 0 {
+		f, name, err := t.captureFile(filename)
+		if err != nil {
+			t.channel.LogEvent("SCP capture failed", "Path", filename, "Error", err.Error())
+		} else {
+			defer f.Close()
+			w = io.MultiWriter(hash, f)
+			captured = name
+		}
+	}
+
+	n, err := io.CopyN(w, src, size)
+	if err != nil {
+		t.channel.LogEvent("SCP "+t.Direction()+" interrupted", "Path", filename, "Bytes", strconv.FormatInt(n, 10), "Size", strconv.FormatInt(size, 10))
+		return err
+	}
+
+	// The source tells if it could read the whole file, then the sink if it
+	// could write it.
+	result := "ok"
+	if err := checkSCPStatus(src); err != nil {
+		result = err.Error()
+	}
+	if err := checkSCPStatus(sink); err == io.EOF {
+		return err
+	} else if err != nil && result == "ok" {
+		result = err.Error()
+	}
+
+	fields := []string{"Path", filename, "Mode", mode, "Bytes", strconv.FormatInt(n, 10), "SHA256", hex.EncodeToString(hash.Sum(nil)), "Result", result}
+	if len(captured) > 0 {
+		fields = append(fields, "Capture", captured)
+	}
+	t.channel.LogEvent("SCP "+t.Direction(), fields...)
+	return nil
+}
+
+// captureFile creates the copy of a file in capture_path, named after the
+// session like the log files.
+func (t *scpTransfer) captureFile(filename string) (*os.File, string, error) {
+	l := t.channel
+	dir := fmt.Sprintf("%s/%d/%d", l.Config.Global.CapturePath, l.StartTime.Year(), l.StartTime.Month())
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, "", err
+	}
+	name := fmt.Sprintf("%s/scp_%s_%s_%s_%d_%d_%s", dir, l.StartTime.Format(time.RFC3339), l.UserName, t.remote, l.ChannelID, t.files, strings.Replace(path.Base(filename), "/", "_", -1))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	return f, name, err
+}
+
+// parseSCPHeader parses the "C" and "D" messages: "C0644 1234 name".
+func parseSCPHeader(line string) (string, int64, string, error) {
+	parts := strings.SplitN(strings.TrimRight(line[1:], "\n"), " ", 3)
+	if len(parts) != 3 {
+		return "", 0, "", fmt.Errorf("can't parse scp message (%s)", strings.TrimSpace(line))
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, "", fmt.Errorf("invalid size in scp message (%s)", strings.TrimSpace(line))
+	}
+	return parts[0], size, parts[2], nil
+}
@@ -1,104 +1,80 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 )
 
 type SSHServer struct {
-	sshConfig *ssh.ServerConfig
+	sshConfig  *ssh.ServerConfig
+	lock       sync.RWMutex
+	reloadLock sync.Mutex
 }
 
-func NewSSHServer() (*SSHServer, error) {
-	s := &SSHServer{
-		sshConfig: &ssh.ServerConfig{
-			NoClientAuth:  false,
-			ServerVersion: "SSH-2.0-BASTION",
-			AuthLogCallback: func(conn ssh.ConnMetadata, method string, err error) {
-				if err != nil {
-					WriteAuthLog("Failed %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
-				} else {
-					WriteAuthLog("Accepted %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
-				}
-			},
-			PasswordCallback: AuthUserPass,
-			PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-				if user, ok := config.Users[conn.User()]; !ok {
-					return nil, fmt.Errorf("user not found in config for PK")
-				} else {
-					if len(user.AuthorizedKeyStr) > 0 {
-						var authKey ssh.PublicKey
-						var authKeysData = []byte(user.AuthorizedKeyStr)
-						var err error
-						authKey, _, _, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
-						if err != nil {
-							log.Printf("Error while processing authorized key string (%s) for user (%s): %s.", user.AuthorizedKeyStr, conn.User(), err)
-							return nil, fmt.Errorf("Error while processing authorized keys file.")
-						}
-
-						if (key.Type() == authKey.Type()) && (bytes.Compare(key.Marshal(), authKey.Marshal()) == 0) {
-							perm := &ssh.Permissions{
-								Extensions: map[string]string{
-									"authType": "pk",
-								},
-							}
-							return perm, nil
-						}
-
-					} else if len(user.AuthorizedKeysFile) > 0 {
-						authKeysData, err := ioutil.ReadFile(user.AuthorizedKeysFile)
-						if err != nil {
-							log.Printf("Unable to read authorized keys file (%s) for user (%s): %s.", user.AuthorizedKeysFile, conn.User(), err)
-							return nil, fmt.Errorf("Unable to read Authorized Keys file.")
-						}
-
-						for {
-							if len(authKeysData) > 0 {
-								var authKey ssh.PublicKey
-								var err error
-								authKey, _, _, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
-								if err != nil {
-									log.Printf("Error while processing authorized keys file (%s) for user (%s): %s.", user.AuthorizedKeysFile, conn.User(), err)
-									return nil, fmt.Errorf("Error while processing authorized keys file.")
-								}
-
-								if (key.Type() == authKey.Type()) && (bytes.Compare(key.Marshal(), authKey.Marshal()) == 0) {
-									perm := &ssh.Permissions{
-										Extensions: map[string]string{
-											"authType": "pk",
-										},
-									}
-									return perm, nil
-								}
-							} else {
-								return nil, fmt.Errorf("No PKs Match - ACCESS DENIED")
-							}
-						}
-					} else {
-						return nil, fmt.Errorf("User has no authorized keys specified.")
-					}
-				}
-				return nil, fmt.Errorf("An error occured while parsing authorized keys")
-			},
-		},
+func NewSSHServer(cfg *SSHConfig) (*SSHServer, error) {
+	sshConfig, err := newServerConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHServer{sshConfig: sshConfig}, nil
+}
+
+// newServerConfig builds the ssh.ServerConfig for cfg. The callbacks always
+// look up the configuration in use at the time of the authentication.
+func newServerConfig(cfg *SSHConfig) (*ssh.ServerConfig, error) {
+	sshConfig := &ssh.ServerConfig{
+		NoClientAuth:      false,
+		ServerVersion:     "SSH-2.0-BASTION",
+		AuthLogCallback:   AuthLog,
+		PasswordCallback:  AuthUserPass,
+		PublicKeyCallback: AuthPublicKey,
+	}
+
+	// Only offer keyboard-interactive when a backend can handle it.
+	if cfg.KeyboardInteractiveEnabled() {
+		sshConfig.KeyboardInteractiveCallback = AuthKeyboardInteractive
 	}
 
-	for _, k := range config.Global.BastionPrivateKeys {
+	for _, k := range cfg.Global.BastionPrivateKeys {
 		hostKey := []byte(k)
 		signer, err := ssh.ParsePrivateKey(hostKey)
 		if err != nil {
 			return nil, fmt.Errorf("Invalid SSH Host Key: %v", err)
 		}
 
-		s.sshConfig.AddHostKey(signer)
+		sshConfig.AddHostKey(signer)
 	}
-	return s, nil
+	return sshConfig, nil
+}
+
+// AuthLog reports the result of an authentication attempt to the auth log,
+// and to the limiter.
+func AuthLog(conn ssh.ConnMetadata, method string, err error) {
+	conn = withLoginUser(conn)
+	if countsAsFailure(method, err) {
+		limiter.Failure(currentConfig(), limiterIP(conn.RemoteAddr()), conn.User())
+	} else if err == nil {
+		limiter.Success(conn.User())
+	}
+
+	if err != nil {
+		WriteAuthLog("Failed %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
+	} else {
+		WriteAuthLog("Accepted %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
+	}
+}
+
+func (s *SSHServer) serverConfig() *ssh.ServerConfig {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.sshConfig
 }
 
 func (s *SSHServer) ListenAndServe(protocol string, addr string) error {
@@ -125,31 +101,124 @@ func (s *SSHServer) Serve(l net.Listener) error {
 func (s *SSHServer) HandleConn(c net.Conn) {
 	startTime := time.Now()
 
-	sshConn, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
-	if err != nil {
+	if limiter.Banned(currentConfig(), limiterIP(c.RemoteAddr())) {
 		c.Close()
 		return
 	}
-	defer WriteAuthLog("Connection closed by %s (User: %s).", sshConn.RemoteAddr(), sshConn.User())
 
-	if sshConn.Permissions == nil || sshConn.Permissions.Extensions == nil {
-		sshConn.Close()
+	sshConn, chans, reqs, err := ssh.NewServerConn(c, s.serverConfig())
+	if err != nil {
+		c.Close()
 		return
 	}
+	// The sessions keep this snapshot even if the configuration is reloaded.
+	user, target := splitLogin(sshConn.User())
+	conn := &BastionConn{ServerConn: sshConn, Config: currentConfig(), StartTime: startTime, user: user, Target: target}
+	defer WriteAuthLog("Connection closed by %s (User: %s).", sshConn.RemoteAddr(), conn.User())
 
-	go ssh.DiscardRequests(reqs)
-	newChannel := <-chans
-	if newChannel == nil {
+	if sshConn.Permissions == nil || sshConn.Permissions.Extensions == nil {
 		sshConn.Close()
 		return
 	}
 
-	switch newChannel.ChannelType() {
-	case "session":
-		s.SessionForward(startTime, sshConn, newChannel, chans)
-	default:
-		newChannel.Reject(ssh.UnknownChannelType, "connection flow not supported, only interactive sessions are permitted.")
+	go s.GlobalRequests(conn, reqs)
+
+	var sessions sync.WaitGroup
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			sessions.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer sessions.Done()
+				s.SessionForward(conn, newChannel)
+			}(newChannel)
+		case "direct-tcpip":
+			sessions.Add(1)
+			go func(newChannel ssh.NewChannel) {
+				defer sessions.Done()
+				s.DirectTCPIPForward(conn, newChannel)
+			}(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "connection flow not supported, only interactive sessions are permitted.")
+		}
 	}
 
 	sshConn.Close()
+	conn.CloseRemoteForwards()
+	sessions.Wait()
+}
+
+// BastionConn is an authenticated client connection. All its channels share
+// the identity of the user, the configuration snapshot and the verification
+// of the second factor. Target is the target given in the login, if any.
+type BastionConn struct {
+	*ssh.ServerConn
+	Config    *SSHConfig
+	StartTime time.Time
+	Target    string
+	user      string
+	channels  int32
+
+	// totpDone is set once the code is verified, totpPrompt is closed when
+	// the prompt in progress on one of the channels ends.
+	totpDone   int32
+	totpLock   sync.Mutex
+	totpPrompt chan struct{}
+
+	forwardLock    sync.Mutex
+	forwards       map[string]net.Listener
+	forwardsClosed bool
+}
+
+// User returns the bastion user, without the target part of the login.
+func (c *BastionConn) User() string {
+	return c.user
+}
+
+// nextChannelID numbers the session channels of the connection from 0.
+func (c *BastionConn) nextChannelID() int {
+	return int(atomic.AddInt32(&c.channels, 1) - 1)
+}
+
+// TOTPPending tells if the user still has to enter a verification code.
+func (c *BastionConn) TOTPPending() bool {
+	if len(c.Permissions.Extensions["totpPending"]) == 0 {
+		return false
+	}
+	return atomic.LoadInt32(&c.totpDone) == 0
+}
+
+// VerifyTOTP asks for the verification code on channel, once per connection.
+// The other channels wait for the verification to end, and ask in turn if it
+// failed. The lock is not held during the prompt.
+func (c *BastionConn) VerifyTOTP(channel io.ReadWriter) error {
+	if len(c.Permissions.Extensions["totpPending"]) == 0 {
+		return nil
+	}
+	for {
+		c.totpLock.Lock()
+		if atomic.LoadInt32(&c.totpDone) == 1 {
+			c.totpLock.Unlock()
+			return nil
+		}
+		if prompt := c.totpPrompt; prompt != nil {
+			c.totpLock.Unlock()
+			<-prompt
+			continue
+		}
+		prompt := make(chan struct{})
+		c.totpPrompt = prompt
+		c.totpLock.Unlock()
+
+		err := VerifyTOTPSession(c.Config, channel, c)
+
+		c.totpLock.Lock()
+		if err == nil {
+			atomic.StoreInt32(&c.totpDone, 1)
+		}
+		c.totpPrompt = nil
+		close(prompt)
+		c.totpLock.Unlock()
+		return err
+	}
 }
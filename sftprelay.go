@@ -0,0 +1,490 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// With sftp_relay in one of their ACLs, users logging in as "user+target" get
+// the SFTP subsystem of the target: the bastion serves the requests of the
+// client with an SFTP client connected to the target, and records each
+// operation in the session logs. The protocol itself is not recorded.
+
+const (
+	sftpRelayReadWrite = "read-write"
+	sftpRelayReadOnly  = "read-only"
+
+	// Data kept while waiting for the missing part of an out of order
+	// transfer, before giving up on its hash.
+	maxPendingHashData = 32 * 1024 * 1024
+)
+
+// SFTPRelay serves the sftp subsystem request req on the target named in the
+// login of conn.
+func SFTPRelay(conn *BastionConn, req *ssh.Request, channel *LogChannel) {
+	config := conn.Config
+	refuse := func(format string, args ...interface{}) {
+		fmt.Fprintf(channel.Stderr(), format+"\r\n", args...)
+		if req.WantReply {
+			req.Reply(false, nil)
+		}
+	}
+
+	names := config.UserACLs(conn.User(), conn.Permissions)
+	acl, ok := config.ResolveACL(names)
+	if !ok || len(acl.SFTPRelay) == 0 {
+		refuse("SFTP relay is not permitted.")
+		WriteAuthLog("Refused SFTP relay to %s by %s from %s.", conn.Target, conn.User(), conn.RemoteAddr())
+		return
+	}
+	name := exactTarget(config, acl.AllowedServers, conn.Target)
+	if len(name) == 0 {
+		refuse("No permitted target is named %s.", conn.Target)
+		return
+	}
+	// Only the ACLs allowing the target grant the relay on it.
+	if acl, _ = config.ResolveServerACL(names, name); len(acl.SFTPRelay) == 0 {
+		refuse("SFTP relay is not permitted on %s.", name)
+		WriteAuthLog("Refused SFTP relay to %s by %s from %s.", name, conn.User(), conn.RemoteAddr())
+		return
+	}
+	if forced := strings.TrimSpace(conn.Permissions.Extensions["forceCommand"]); len(forced) > 0 && forced != name {
+		refuse("Forced target %s is not permitted.", name)
+		WriteAuthLog("Refused SFTP relay to %s by %s from %s: forced target is %s.", name, conn.User(), conn.RemoteAddr(), forced)
+		return
+	}
+	remote, ok := config.Servers[name]
+	if !ok {
+		refuse("Incorrectly Configured Server Selected.")
+		return
+	}
+	if _, err := remote.RequestPolicy.Check(req.Type, req.Payload); err != nil {
+		channel.LogEvent("Request denied", "Type", req.Type, "Reason", err.Error())
+		refuse("SFTP is not permitted on %s.", name)
+		return
+	}
+
+	if err := channel.RelayStart(name); err != nil {
+		refuse("Failed to Initialize Session.")
+		return
+	}
+	client, address, err := dialRemote(conn, name, remote, nil, false)
+	if err != nil {
+		refuse("Connect failed: %v", err)
+		return
+	}
+	defer client.Close()
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		refuse("Remote sftp setup failed: %v", err)
+		return
+	}
+	defer sftpClient.Close()
+	if req.WantReply {
+		req.Reply(true, nil)
+	}
+
+	WriteAuthLog("Connected to remote for sftp relay (%s) by %s from %s.", address, conn.User(), conn.RemoteAddr())
+	defer WriteAuthLog("Disconnected from remote for sftp relay (%s) by %s from %s.", address, conn.User(), conn.RemoteAddr())
+	channel.LogEvent("SFTP relay started", "Target", name, "Address", address, "Mode", acl.SFTPRelay, "Paths", strings.Join(acl.SFTPRelayPaths, ","))
+
+	relay := &sftpRelay{
+		client:  sftpClient,
+		channel: channel,
+		target:  name,
+		grants:  acl.SFTPGrants,
+	}
+	server := sftp.NewRequestServer(channel.ActualChannel, sftp.Handlers{
+		FileGet:  relay,
+		FilePut:  relay,
+		FileCmd:  relay,
+		FileList: relay,
+	})
+	if err := server.Serve(); err != nil && err != io.EOF {
+		log.Printf("sftp relay completed with error: %v\n", err)
+	}
+	server.Close()
+	channel.LogEvent("SFTP relay ended", "Target", name)
+}
+
+// sftpGrant is the sftp_relay mode of an ACL with its path prefixes and the
+// servers it applies to.
+type sftpGrant struct {
+	Mode    string
+	Paths   []string
+	Servers []string
+}
+
+// sftpRelay implements the request server handlers on top of an SFTP client,
+// within the modes and path prefixes allowed on target by the ACLs.
+type sftpRelay struct {
+	client  *sftp.Client
+	channel *LogChannel
+	target  string
+	grants  []sftpGrant
+}
+
+// permitted tells if p is within one of the path prefixes allowed on the
+// target, by a read-write ACL for a write. The parents of the prefixes can be looked up
+// with stat, so the clients can change to them.
+func (r *sftpRelay) permitted(p string, write bool, lookup bool) bool {
+	p = path.Clean("/" + p)
+	for _, g := range r.grants {
+		if !contains(g.Servers, r.target) || (write && g.Mode != sftpRelayReadWrite) {
+			continue
+		}
+		for _, prefix := range g.Paths {
+			prefix = path.Clean("/" + prefix)
+			if prefix == "/" || p == prefix || strings.HasPrefix(p, prefix+"/") {
+				return true
+			}
+			if lookup && (p == "/" || strings.HasPrefix(prefix, p+"/")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *sftpRelay) deny(method string, paths ...string) error {
+	r.channel.LogEvent("SFTP denied", "Operation", method, "Path", strings.Join(paths, " -> "))
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+// check refuses a request on paths outside the allowed prefixes, or a write
+// outside the prefixes of the read-write ACLs.
+func (r *sftpRelay) check(method string, write bool, paths ...string) error {
+	for _, p := range paths {
+		if !r.permitted(p, write, method == "Stat" || method == "Lstat") {
+			return r.deny(method, paths...)
+		}
+	}
+	return nil
+}
+
+// relayError converts the errors of the client into status codes, which the
+// request server would otherwise send as generic failures.
+func relayError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return sftp.ErrSSHFxNoSuchFile
+	case os.IsPermission(err):
+		return sftp.ErrSSHFxPermissionDenied
+	case err == io.EOF:
+		return sftp.ErrSSHFxEOF
+	}
+	return err
+}
+
+func (r *sftpRelay) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+	if err := r.check("Read", false, request.Filepath); err != nil {
+		return nil, err
+	}
+	return r.open(request, os.O_RDONLY)
+}
+
+func (r *sftpRelay) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+	if err := r.check("Write", true, request.Filepath); err != nil {
+		return nil, err
+	}
+	return r.open(request, os.O_WRONLY)
+}
+
+func (r *sftpRelay) OpenFile(request *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if err := r.check("Open", true, request.Filepath); err != nil {
+		return nil, err
+	}
+	return r.open(request, os.O_RDWR)
+}
+
+func (r *sftpRelay) open(request *sftp.Request, flags int) (*relayFile, error) {
+	pflags := request.Pflags()
+	names := []string{"read"}
+	if flags != os.O_RDONLY {
+		names = []string{"write"}
+		if flags == os.O_RDWR {
+			names = []string{"read", "write"}
+		}
+		for _, f := range []struct {
+			set  bool
+			flag int
+			name string
+		}{
+			{pflags.Append, os.O_APPEND, "append"},
+			{pflags.Creat, os.O_CREATE, "create"},
+			{pflags.Trunc, os.O_TRUNC, "truncate"},
+			{pflags.Excl, os.O_EXCL, "exclusive"},
+		} {
+			if f.set {
+				flags |= f.flag
+				names = append(names, f.name)
+			}
+		}
+	}
+
+	file, err := r.client.OpenFile(request.Filepath, flags)
+	r.channel.LogEvent("SFTP open", "Path", request.Filepath, "Flags", strings.Join(names, ","), "Result", resultString(err))
+	if err != nil {
+		return nil, relayError(err)
+	}
+	return &relayFile{
+		file:    file,
+		channel: r.channel,
+		path:    request.Filepath,
+		reading: flags&(os.O_WRONLY|os.O_RDWR) != os.O_WRONLY,
+		writing: flags&(os.O_WRONLY|os.O_RDWR) != os.O_RDONLY,
+	}, nil
+}
+
+func (r *sftpRelay) Filecmd(request *sftp.Request) error {
+	paths := []string{request.Filepath}
+	if request.Method == "Rename" || request.Method == "Link" || request.Method == "Symlink" {
+		paths = append(paths, request.Target)
+	}
+	if err := r.check(request.Method, true, paths...); err != nil {
+		return err
+	}
+
+	var err error
+	fields := []string{"Path", request.Filepath}
+	switch request.Method {
+	case "Setstat":
+		attrFlags, attrs := request.AttrFlags(), request.Attributes()
+		if attrFlags.Size {
+			fields = append(fields, "Size", strconv.FormatUint(attrs.Size, 10))
+			err = r.client.Truncate(request.Filepath, int64(attrs.Size))
+		}
+		if attrFlags.Permissions && err == nil {
+			fields = append(fields, "Mode", fmt.Sprintf("%04o", attrs.FileMode().Perm()))
+			err = r.client.Chmod(request.Filepath, attrs.FileMode().Perm())
+		}
+		if attrFlags.UidGid && err == nil {
+			fields = append(fields, "Owner", fmt.Sprintf("%d:%d", attrs.UID, attrs.GID))
+			err = r.client.Chown(request.Filepath, int(attrs.UID), int(attrs.GID))
+		}
+		if attrFlags.Acmodtime && err == nil {
+			fields = append(fields, "Modification time", time.Unix(int64(attrs.Mtime), 0).Format(time.RFC3339))
+			err = r.client.Chtimes(request.Filepath, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0))
+		}
+	case "Rename":
+		fields = append(fields, "Target", request.Target)
+		err = r.client.Rename(request.Filepath, request.Target)
+	case "Rmdir":
+		err = r.client.RemoveDirectory(request.Filepath)
+	case "Mkdir":
+		err = r.client.Mkdir(request.Filepath)
+	case "Link":
+		fields = append(fields, "Target", request.Target)
+		err = r.client.Link(request.Filepath, request.Target)
+	case "Symlink":
+		// The request server gives the content of the link as Filepath.
+		fields = []string{"Path", request.Target, "Target", request.Filepath}
+		err = r.client.Symlink(request.Filepath, request.Target)
+	case "Remove":
+		err = r.client.Remove(request.Filepath)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	r.channel.LogEvent("SFTP "+strings.ToLower(request.Method), append(fields, "Result", resultString(err))...)
+	return relayError(err)
+}
+
+func (r *sftpRelay) PosixRename(request *sftp.Request) error {
+	if err := r.check("PosixRename", true, request.Filepath, request.Target); err != nil {
+		return err
+	}
+	err := r.client.PosixRename(request.Filepath, request.Target)
+	r.channel.LogEvent("SFTP rename", "Path", request.Filepath, "Target", request.Target, "Result", resultString(err))
+	return relayError(err)
+}
+
+func (r *sftpRelay) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+	if err := r.check(request.Method, false, request.Filepath); err != nil {
+		return nil, err
+	}
+
+	switch request.Method {
+	case "List":
+		files, err := r.client.ReadDir(request.Filepath)
+		if err != nil {
+			return nil, relayError(err)
+		}
+		return ListerAt(files), nil
+	case "Stat":
+		s, err := r.client.Stat(request.Filepath)
+		if err != nil {
+			return nil, relayError(err)
+		}
+		return ListerAt([]os.FileInfo{s}), nil
+	case "Readlink":
+		target, err := r.client.ReadLink(request.Filepath)
+		if err != nil {
+			return nil, relayError(err)
+		}
+		return ListerAt([]os.FileInfo{linkTarget(target)}), nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (r *sftpRelay) Lstat(request *sftp.Request) (sftp.ListerAt, error) {
+	if err := r.check("Lstat", false, request.Filepath); err != nil {
+		return nil, err
+	}
+	s, err := r.client.Lstat(request.Filepath)
+	if err != nil {
+		return nil, relayError(err)
+	}
+	return ListerAt([]os.FileInfo{s}), nil
+}
+
+// RealPath resolves the paths on the target, so relative paths start from the
+// home directory of the remote user.
+func (r *sftpRelay) RealPath(p string) string {
+	resolved, err := r.client.RealPath(p)
+	if err != nil {
+		return path.Clean("/" + p)
+	}
+	return resolved
+}
+
+func resultString(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "ok"
+}
+
+// linkTarget is the answer to a readlink request: the request server sends
+// the name of the file info.
+type linkTarget string
+
+func (l linkTarget) Name() string       { return string(l) }
+func (l linkTarget) Size() int64        { return 0 }
+func (l linkTarget) Mode() os.FileMode  { return os.ModeSymlink }
+func (l linkTarget) ModTime() time.Time { return time.Time{} }
+func (l linkTarget) IsDir() bool        { return false }
+func (l linkTarget) Sys() interface{}   { return nil }
+
+// relayFile counts and hashes the data read from and written to a file of
+// the target, and records them when the client closes it.
+type relayFile struct {
+	file    *sftp.File
+	channel *LogChannel
+	path    string
+	reading bool
+	writing bool
+
+	lock     sync.Mutex
+	read     transferHash
+	written  transferHash
+	closed   bool
+	closeErr error
+}
+
+func (f *relayFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.file.ReadAt(b, off)
+	f.lock.Lock()
+	f.read.add(b[:n], off)
+	f.lock.Unlock()
+	return n, err
+}
+
+func (f *relayFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.file.WriteAt(b, off)
+	f.lock.Lock()
+	f.written.add(b[:n], off)
+	f.lock.Unlock()
+	return n, err
+}
+
+func (f *relayFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return f.closeErr
+	}
+	f.closed = true
+	f.closeErr = f.file.Close()
+
+	if f.reading {
+		f.channel.LogEvent("SFTP read", "Path", f.path, "Bytes", strconv.FormatInt(f.read.bytes, 10), "SHA256", f.read.sum())
+	}
+	if f.writing {
+		f.channel.LogEvent("SFTP write", "Path", f.path, "Bytes", strconv.FormatInt(f.written.bytes, 10), "SHA256", f.written.sum(), "Result", resultString(f.closeErr))
+	}
+	return f.closeErr
+}
+
+// transferHash computes the SHA-256 of the data transferred from the start of
+// a file. The request server handles reads and writes concurrently, so the
+// chunks coming before the data hashed so far are kept until it catches up.
+type transferHash struct {
+	bytes   int64
+	hash    hash.Hash
+	offset  int64
+	pending map[int64][]byte
+	size    int
+	broken  bool
+}
+
+func (t *transferHash) add(data []byte, off int64) {
+	t.bytes += int64(len(data))
+	if t.broken || len(data) == 0 {
+		return
+	}
+	if t.hash == nil {
+		t.hash = sha256.New()
+		t.pending = map[int64][]byte{}
+	}
+
+	if off != t.offset {
+		if _, ok := t.pending[off]; ok || off < t.offset || t.size+len(data) > maxPendingHashData {
+			// Data transferred again, or not from the start of the file.
+			t.broken = true
+			t.pending = nil
+			return
+		}
+		t.pending[off] = append([]byte{}, data...)
+		t.size += len(data)
+		return
+	}
+
+	t.hash.Write(data)
+	t.offset += int64(len(data))
+	for {
+		next, ok := t.pending[t.offset]
+		if !ok {
+			break
+		}
+		delete(t.pending, t.offset)
+		t.size -= len(next)
+		t.hash.Write(next)
+		t.offset += int64(len(next))
+	}
+}
+
+func (t *transferHash) sum() string {
+	if t.broken || len(t.pending) > 0 {
+		return "not computed (partial or non-sequential transfer)"
+	}
+	if t.hash == nil {
+		return hex.EncodeToString(sha256.New().Sum(nil))
+	}
+	return hex.EncodeToString(t.hash.Sum(nil))
+}
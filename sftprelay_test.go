@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+// A read-only ACL and a read-write ACL merged for the same user: the paths of
+// the read-only ACL must not become writable.
+func TestSFTPRelayMergedACLsKeepReadOnlyPaths(t *testing.T) {
+	config := &SSHConfig{ACLs: map[string]SSHConfigACL{
+		"readers": {AllowedServers: []string{"files01"}, SFTPRelay: sftpRelayReadOnly, SFTPRelayPaths: []string{"/srv/data"}},
+		"writers": {AllowedServers: []string{"files01"}, SFTPRelay: sftpRelayReadWrite, SFTPRelayPaths: []string{"/srv/upload"}},
+	}}
+	acl, ok := config.ResolveACL([]string{"readers", "writers"})
+	if !ok {
+		t.Fatal("ResolveACL found none of the ACLs")
+	}
+	relay := &sftpRelay{
+		channel: &LogChannel{initialBuffer: new(bytes.Buffer), reqBuffer: new(bytes.Buffer), logMutex: &sync.Mutex{}},
+		target:  "files01",
+		grants:  acl.SFTPGrants,
+	}
+
+	tests := []struct {
+		method string
+		write  bool
+		paths  []string
+		ok     bool
+	}{
+		{"Read", false, []string{"/srv/data/report.csv"}, true},
+		{"Read", false, []string{"/srv/upload/file"}, true},
+		{"Write", true, []string{"/srv/upload/file"}, true},
+		{"Write", true, []string{"/srv/data/report.csv"}, false},
+		{"Remove", true, []string{"/srv/data/report.csv"}, false},
+		{"Rename", true, []string{"/srv/data/report.csv", "/srv/upload/report.csv"}, false},
+		{"Rename", true, []string{"/srv/upload/a", "/srv/upload/b"}, true},
+		{"Read", false, []string{"/etc/passwd"}, false},
+		{"Stat", false, []string{"/srv"}, true},
+	}
+	for _, tt := range tests {
+		err := relay.check(tt.method, tt.write, tt.paths...)
+		if (err == nil) != tt.ok {
+			t.Errorf("check(%s, %v) = %v, want allowed %v", tt.method, tt.paths, err, tt.ok)
+		}
+	}
+}
+
+// A grant of an ACL doesn't apply on the servers allowed by another ACL only.
+func TestSFTPRelayGrantsKeepTheirServers(t *testing.T) {
+	config := &SSHConfig{ACLs: map[string]SSHConfigACL{
+		"uploads": {AllowedServers: []string{"files01"}, SFTPRelay: sftpRelayReadWrite},
+		"admins":  {AllowedServers: []string{"db01"}},
+	}}
+	acl, _ := config.ResolveACL([]string{"uploads", "admins"})
+	for _, tt := range []struct {
+		target string
+		ok     bool
+	}{
+		{"files01", true},
+		{"db01", false},
+	} {
+		relay := &sftpRelay{
+			channel: &LogChannel{initialBuffer: new(bytes.Buffer), reqBuffer: new(bytes.Buffer), logMutex: &sync.Mutex{}},
+			target:  tt.target,
+			grants:  acl.SFTPGrants,
+		}
+		if err := relay.check("Write", true, "/srv/file"); (err == nil) != tt.ok {
+			t.Errorf("Write on %s = %v, want allowed %v", tt.target, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Users can name their target in the login, as "user+target", or as the
+// command of the session ("ssh -t bastion target"), instead of using the
+// selection menu.
+
+// splitLogin splits a "user+target" login. The target is empty when the
+// login doesn't contain one.
+func splitLogin(login string) (string, string) {
+	i := strings.Index(login, "+")
+	if i <= 0 || i == len(login)-1 {
+		return login, ""
+	}
+	return login[:i], login[i+1:]
+}
+
+// loginMetadata hides the target part of the login from the authentication
+// backends.
+type loginMetadata struct {
+	ssh.ConnMetadata
+	user string
+}
+
+func (m loginMetadata) User() string {
+	return m.user
+}
+
+func withLoginUser(conn ssh.ConnMetadata) ssh.ConnMetadata {
+	user, target := splitLogin(conn.User())
+	if len(target) == 0 {
+		return conn
+	}
+	return loginMetadata{ConnMetadata: conn, user: user}
+}
+
+// exactTarget looks name up in the allowed servers by name or full_name
+// only. Commands and file transfers run on a target named exactly, as nobody
+// is there to notice a wrong match.
+func exactTarget(config *SSHConfig, allowed []string, name string) string {
+	for _, s := range allowed {
+		if s == name {
+			return s
+		}
+		if server, ok := config.Servers[s]; ok && len(server.FullName) > 0 && server.FullName == name {
+			return s
+		}
+	}
+	return ""
+}
+
+// resolveTarget looks name up in the allowed servers, by name or full_name
+// first, then as a part of a name for the interactive sessions. It returns
+// the server found, and the allowed servers matching name when it is
+// ambiguous.
+func resolveTarget(config *SSHConfig, allowed []string, name string) (string, []string) {
+	if s := exactTarget(config, allowed, name); len(s) > 0 {
+		return s, nil
+	}
+
+	matches := []string{}
+	for _, s := range allowed {
+		if strings.Contains(s, name) {
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	return "", matches
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Users can open direct-tcpip channels (ssh -L, -D or -W) to the destinations
+// matching the allow_forwards patterns of their ACLs. The bastion connects to
+// the destination itself and relays the data. A pattern is "host:port": the
+// host is a name, a wildcard pattern or a CIDR, the port a number or "*".
+
+type directTCPIPPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// DirectTCPIPForward serves a direct-tcpip channel of conn.
+func (s *SSHServer) DirectTCPIPForward(conn *BastionConn, newChannel ssh.NewChannel) {
+	config := conn.Config
+
+	var payload directTCPIPPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid direct-tcpip request")
+		return
+	}
+	destination := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	refuse := func(reason string) {
+		WriteAuthLog("Refused port forwarding to %s by %s from %s: %s.", destination, conn.User(), conn.RemoteAddr(), reason)
+		newChannel.Reject(ssh.Prohibited, "port forwarding to "+destination+" is not permitted")
+	}
+
+	if conn.TOTPPending() {
+		refuse("verification code required")
+		return
+	}
+	if len(conn.Permissions.Extensions["noPortForwarding"]) > 0 {
+		refuse("no-port-forwarding key option")
+		return
+	}
+	acl, ok := config.ResolveACL(config.UserACLs(conn.User(), conn.Permissions))
+	if !ok {
+		refuse("no ACL")
+		return
+	}
+	var permitOpen []string
+	if len(conn.Permissions.Extensions["permitOpen"]) > 0 {
+		permitOpen = strings.Split(conn.Permissions.Extensions["permitOpen"], ",")
+	}
+	addr, err := forwardAddress(acl.AllowForwards, permitOpen, payload.Host, payload.Port)
+	if err != nil {
+		refuse(err.Error())
+		return
+	}
+
+	timeout, err := time.ParseDuration(config.Global.ConnectTimeout)
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	target, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		WriteAuthLog("Port forwarding to %s (%s) by %s from %s failed: %v.", destination, addr, conn.User(), conn.RemoteAddr(), err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer target.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	start := time.Now()
+	WriteAuthLog("Opened port forwarding to %s (%s) by %s from %s, originator %s:%d.", destination, addr, conn.User(), conn.RemoteAddr(), payload.OriginHost, payload.OriginPort)
+
+	sent, received := relayTCP(channel, target)
+	WriteAuthLog("Closed port forwarding to %s (%s) by %s from %s: %d bytes sent, %d bytes received, duration %s.", destination, addr, conn.User(), conn.RemoteAddr(), sent, received, time.Since(start).Round(time.Second))
+}
+
+// relayTCP copies the data between channel and c until both directions are
+// closed, and returns the number of bytes sent to c and received from it.
+func relayTCP(channel ssh.Channel, c io.ReadWriter) (int64, int64) {
+	var sent, received int64
+	done := make(chan struct{})
+	go func() {
+		received, _ = io.Copy(channel, c)
+		channel.CloseWrite()
+		close(done)
+	}()
+	sent, _ = io.Copy(c, channel)
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	<-done
+	return sent, received
+}
+
+// forwardAddress checks host and port against the allow_forwards patterns and
+// the permitopen key options, and returns the address to connect to. Names
+// are resolved to be checked against CIDR patterns, the address checked is
+// then the one connected to.
+func forwardAddress(patterns []string, permitOpen []string, host string, port uint32) (string, error) {
+	host = strings.ToLower(host)
+	if len(permitOpen) > 0 {
+		permitted := false
+		for _, p := range permitOpen {
+			if matchForwardPattern(p, host, port) {
+				permitted = true
+				break
+			}
+		}
+		if !permitted {
+			return "", fmt.Errorf("not in the permitopen key options")
+		}
+	}
+
+	networks := []*net.IPNet{}
+	for _, p := range patterns {
+		if matchForwardPattern(p, host, port) {
+			return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+		}
+		h, ports, err := net.SplitHostPort(p)
+		if err != nil || !matchForwardPort(ports, port) {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(h); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	if len(networks) == 0 {
+		return "", fmt.Errorf("no matching allow_forwards")
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = net.LookupIP(host); err != nil {
+			return "", fmt.Errorf("unable to resolve %s", host)
+		}
+	}
+	for _, ip := range ips {
+		for _, network := range networks {
+			if network.Contains(ip) {
+				return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no matching allow_forwards")
+}
+
+// matchForwardPattern matches host and port against a "host:port" pattern,
+// with a name or a wildcard pattern as host.
+func matchForwardPattern(pattern string, host string, port uint32) bool {
+	h, ports, err := net.SplitHostPort(pattern)
+	if err != nil || !matchForwardPort(ports, port) {
+		return false
+	}
+	matched, err := path.Match(strings.ToLower(h), host)
+	return err == nil && matched
+}
+
+func matchForwardPort(pattern string, port uint32) bool {
+	return pattern == "*" || pattern == strconv.Itoa(int(port))
+}
+
+// checkForwardPattern validates an allow_forwards or permitopen pattern.
+func checkForwardPattern(pattern string) error {
+	h, ports, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return err
+	}
+	if ports != "*" {
+		if p, err := strconv.Atoi(ports); err != nil || p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid port %q", ports)
+		}
+	}
+	if strings.Contains(h, "/") {
+		if _, _, err := net.ParseCIDR(h); err != nil {
+			return fmt.Errorf("invalid network %q", h)
+		}
+	} else if _, err := path.Match(h, ""); err != nil {
+		return fmt.Errorf("invalid host pattern %q", h)
+	}
+	return nil
+}
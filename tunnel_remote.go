@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Users can ask the bastion to listen for them (ssh -R) on the addresses and
+// ports matching the allow_remote_forwards patterns of their ACLs, so a target
+// can connect back to a service of the client. A pattern is "address:port":
+// the address is an IP address of the bastion or "localhost", the port a
+// number, a range ("9000-9099") or "*". The listeners are closed with the
+// connection.
+
+type tcpipForwardPayload struct {
+	Addr string
+	Port uint32
+}
+
+type forwardedTCPIPPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// GlobalRequests serves the global requests of conn: tcpip-forward and
+// cancel-tcpip-forward, the other ones are refused.
+func (s *SSHServer) GlobalRequests(conn *BastionConn, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port, err := conn.StartRemoteForward(payload.Addr, payload.Port)
+			if err != nil {
+				WriteAuthLog("Refused remote port forwarding on %s by %s from %s: %v.", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))), conn.User(), conn.RemoteAddr(), err)
+				req.Reply(false, nil)
+				continue
+			}
+			if payload.Port == 0 {
+				req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+			} else {
+				req.Reply(true, nil)
+			}
+		case "cancel-tcpip-forward":
+			var payload tcpipForwardPayload
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(conn.CancelRemoteForward(payload.Addr, payload.Port), nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// StartRemoteForward listens on addr and port for the client, and returns the
+// port listened on.
+func (c *BastionConn) StartRemoteForward(addr string, port uint32) (uint32, error) {
+	if c.TOTPPending() {
+		return 0, fmt.Errorf("verification code required")
+	}
+	if len(c.Permissions.Extensions["noPortForwarding"]) > 0 {
+		return 0, fmt.Errorf("no-port-forwarding key option")
+	}
+	acl, ok := c.Config.ResolveACL(c.Config.UserACLs(c.User(), c.Permissions))
+	if !ok || !remoteForwardAllowed(acl.AllowRemoteForwards, addr, port) {
+		return 0, fmt.Errorf("no matching allow_remote_forwards")
+	}
+
+	c.forwardLock.Lock()
+	defer c.forwardLock.Unlock()
+	if c.forwardsClosed {
+		return 0, fmt.Errorf("connection closed")
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, strconv.Itoa(int(port))))
+	if err != nil {
+		return 0, err
+	}
+	port = uint32(l.Addr().(*net.TCPAddr).Port)
+	listen := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	if c.forwards == nil {
+		c.forwards = map[string]net.Listener{}
+	}
+	c.forwards[listen] = l
+	WriteAuthLog("Opened remote port forwarding on %s (%s) by %s from %s.", listen, l.Addr(), c.User(), c.RemoteAddr())
+
+	go func() {
+		for {
+			tc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go c.forwardConnection(tc, addr, port)
+		}
+	}()
+	return port, nil
+}
+
+// CancelRemoteForward closes the listener on addr and port.
+func (c *BastionConn) CancelRemoteForward(addr string, port uint32) bool {
+	listen := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	c.forwardLock.Lock()
+	defer c.forwardLock.Unlock()
+	l, ok := c.forwards[listen]
+	if !ok {
+		return false
+	}
+	l.Close()
+	delete(c.forwards, listen)
+	WriteAuthLog("Closed remote port forwarding on %s by %s from %s.", listen, c.User(), c.RemoteAddr())
+	return true
+}
+
+// CloseRemoteForwards closes the listeners of the connection, and refuses
+// the later requests.
+func (c *BastionConn) CloseRemoteForwards() {
+	c.forwardLock.Lock()
+	defer c.forwardLock.Unlock()
+	c.forwardsClosed = true
+	for listen, l := range c.forwards {
+		l.Close()
+		delete(c.forwards, listen)
+		WriteAuthLog("Closed remote port forwarding on %s by %s from %s.", listen, c.User(), c.RemoteAddr())
+	}
+}
+
+// forwardConnection relays a connection accepted on a listener of the client
+// over a forwarded-tcpip channel.
+func (c *BastionConn) forwardConnection(tc net.Conn, addr string, port uint32) {
+	defer tc.Close()
+	listen := net.JoinHostPort(addr, strconv.Itoa(int(port)))
+	origin := tc.RemoteAddr().(*net.TCPAddr)
+
+	channel, reqs, err := c.OpenChannel("forwarded-tcpip", ssh.Marshal(forwardedTCPIPPayload{addr, port, origin.IP.String(), uint32(origin.Port)}))
+	if err != nil {
+		WriteAuthLog("Remote port forwarding from %s to %s refused by %s from %s: %v.", origin, listen, c.User(), c.RemoteAddr(), err)
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	start := time.Now()
+	WriteAuthLog("Opened remote port forwarding from %s to %s by %s from %s.", origin, listen, c.User(), c.RemoteAddr())
+	sent, received := relayTCP(channel, tc)
+	WriteAuthLog("Closed remote port forwarding from %s to %s by %s from %s: %d bytes sent, %d bytes received, duration %s.", origin, listen, c.User(), c.RemoteAddr(), sent, received, time.Since(start).Round(time.Second))
+}
+
+// remoteForwardAllowed matches a bind address and port against the
+// allow_remote_forwards patterns. Port 0, chosen by the bastion, needs a "*"
+// pattern.
+func remoteForwardAllowed(patterns []string, addr string, port uint32) bool {
+	ip := net.ParseIP(addr)
+	for _, p := range patterns {
+		h, ports, err := net.SplitHostPort(p)
+		if err != nil {
+			continue
+		}
+		if pip := net.ParseIP(h); !strings.EqualFold(h, addr) && (pip == nil || ip == nil || !pip.Equal(ip)) {
+			continue
+		}
+		if ports == "*" {
+			return true
+		}
+		low, high, err := parsePortRange(ports)
+		if err == nil && port != 0 && low <= int(port) && int(port) <= high {
+			return true
+		}
+	}
+	return false
+}
+
+func parsePortRange(ports string) (int, int, error) {
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(bounds[1]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if low <= 0 || high > 65535 || low > high {
+		return 0, 0, fmt.Errorf("invalid port range %q", ports)
+	}
+	return low, high, nil
+}
+
+// checkRemoteForwardPattern validates an allow_remote_forwards pattern. The
+// wildcard addresses are refused, the bastion must only listen on loopback or
+// internal addresses.
+func checkRemoteForwardPattern(pattern string) error {
+	h, ports, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return err
+	}
+	if ports != "*" {
+		if _, _, err := parsePortRange(ports); err != nil {
+			return fmt.Errorf("invalid port %q", ports)
+		}
+	}
+	if strings.EqualFold(h, "localhost") {
+		return nil
+	}
+	ip := net.ParseIP(h)
+	if ip == nil {
+		return fmt.Errorf("%q is not an IP address or localhost", h)
+	}
+	if ip.IsUnspecified() {
+		return fmt.Errorf("wildcard address %q is not allowed", h)
+	}
+	return nil
+}
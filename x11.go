@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// With allow_x11 set on one of the ACLs of the user or on the target, the
+// x11-req requests of the sessions are sent to the target, and the x11
+// channels the target then opens are relayed to the client. Otherwise the
+// x11-req requests are refused by the bastion.
+
+type x11ChannelPayload struct {
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ForwardX11 relays to the client the x11 channels opened by the target of
+// client. It must be called before the x11-req request is sent.
+func ForwardX11(conn *BastionConn, channel *LogChannel, client *ssh.Client, remote_name string) {
+	channels := client.HandleChannelOpen("x11")
+	go func() {
+		for newChannel := range channels {
+			go forwardX11Channel(conn, channel, newChannel, remote_name)
+		}
+	}()
+}
+
+func forwardX11Channel(conn *BastionConn, session *LogChannel, newChannel ssh.NewChannel, remote_name string) {
+	var payload x11ChannelPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "invalid x11 request")
+		return
+	}
+	origin := net.JoinHostPort(payload.OriginAddr, strconv.Itoa(int(payload.OriginPort)))
+
+	display, displayReqs, err := conn.OpenChannel("x11", newChannel.ExtraData())
+	if err != nil {
+		WriteAuthLog("X11 forwarding from %s (%s) refused by %s from %s: %v.", remote_name, origin, conn.User(), conn.RemoteAddr(), err)
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer display.Close()
+	go ssh.DiscardRequests(displayReqs)
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+
+	start := time.Now()
+	WriteAuthLog("Opened X11 forwarding from %s (%s) by %s from %s.", remote_name, origin, conn.User(), conn.RemoteAddr())
+	session.LogEvent("X11 channel opened", "Target", remote_name, "Origin", origin)
+
+	sent, received := relayTCP(channel, display)
+	WriteAuthLog("Closed X11 forwarding from %s (%s) by %s from %s: %d bytes sent, %d bytes received, duration %s.", remote_name, origin, conn.User(), conn.RemoteAddr(), sent, received, time.Since(start).Round(time.Second))
+	session.LogEvent("X11 channel closed", "Origin", origin, "Bytes sent", strconv.FormatInt(sent, 10), "Bytes received", strconv.FormatInt(received, 10))
+}